@@ -0,0 +1,43 @@
+package erdle
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+type chanReader struct {
+	queue  <-chan []byte
+	framed bool
+	rest   []byte
+}
+
+// ChanReader gives the packets received from q as a continuous stream of bytes.
+// Read returns io.EOF once q is closed and all its packets have been read.
+func ChanReader(q <-chan []byte) io.Reader {
+	return &chanReader{queue: q}
+}
+
+// FramedChanReader is like ChanReader but each packet is preceded by its length
+// (4 bytes, little endian) so that the packets can be split again.
+func FramedChanReader(q <-chan []byte) io.Reader {
+	return &chanReader{queue: q, framed: true}
+}
+
+func (r *chanReader) Read(bs []byte) (int, error) {
+	for len(r.rest) == 0 {
+		xs, ok := <-r.queue
+		if !ok {
+			return 0, io.EOF
+		}
+		if !r.framed {
+			r.rest = xs
+			continue
+		}
+		r.rest = make([]byte, 4+len(xs))
+		binary.LittleEndian.PutUint32(r.rest, uint32(len(xs)))
+		copy(r.rest[4:], xs)
+	}
+	n := copy(bs, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
@@ -0,0 +1,94 @@
+package erdle
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+// Channels reads the cadus from r and gives the sorted list of the channels of
+// the HRDL packets they carry. Only the headers of the packets are decoded (see
+// DecodeHRDLHeader): packets are neither reassembled nor verified.
+//
+// As for Survey, r is wrapped with VCDUReader if it is not a reader returned by
+// VCDUReader or CaduReader and a reader returned by CaduReader is not modified.
+// Corrupted cadus are skipped and the headers split over a missing or a
+// corrupted cadu (or over the bytes skipped to resync) are ignored.
+func Channels(r io.Reader) ([]uint8, error) {
+	v := frameReader(r)
+
+	var (
+		frame  = make([]byte, CaduLen)
+		header = make([]byte, WordLen+HRDLSizeLen+VMUHeaderLen)
+		buffer []byte
+		seen   = make(map[uint8]struct{})
+	)
+	for {
+		n, err := v.Read(frame)
+		if err == io.EOF {
+			break
+		}
+		if _, ok := IsMissingCadu(err); ok {
+			buffer = buffer[:0]
+		} else if _, ok := IsResync(err); ok {
+			buffer = buffer[:0]
+		} else if IsCRCError(err) || IsOutOfOrder(err) {
+			buffer = buffer[:0]
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if n < CaduLen {
+			continue
+		}
+		buffer = append(buffer, frame[CaduHeaderLen:CaduTrailerIndex]...)
+		for {
+			ix := bytes.Index(buffer, Word)
+			if ix < 0 {
+				// only keep the bytes that could be the beginning of the word
+				if n := len(buffer) - WordLen + 1; n > 0 {
+					buffer = append(buffer[:0], buffer[n:]...)
+				}
+				break
+			}
+			buffer = buffer[ix:]
+			if !unstuffHeader(buffer, header) {
+				break
+			}
+			if h, err := DecodeHRDLHeader(header); err == nil {
+				seen[h.Channel] = struct{}{}
+			}
+			buffer = buffer[WordLen:]
+		}
+	}
+	cs := make([]uint8, 0, len(seen))
+	for c := range seen {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i] < cs[j] })
+	return cs, nil
+}
+
+// unstuffHeader fills header with the unstuffed bytes of the beginning of the
+// stuffed packet bs. It reports false if bs is too short.
+func unstuffHeader(bs, header []byte) bool {
+	if len(bs) < WordLen+HRDLSizeLen {
+		return false
+	}
+	n := copy(header, bs[:WordLen+HRDLSizeLen])
+	for bs = bs[n:]; n < len(header) && len(bs) > 0; {
+		if len(bs) < len(Stuff) && bytes.HasPrefix(Stuff, bs) {
+			// the marker could be split with the next cadu
+			return false
+		}
+		if bytes.HasPrefix(bs, Stuff) {
+			// the stuff marker replaces the first 3 bytes of the word
+			n += copy(header[n:], Stuff[:3])
+			bs = bs[len(Stuff):]
+			continue
+		}
+		header[n] = bs[0]
+		n, bs = n+1, bs[1:]
+	}
+	return n >= len(header)
+}
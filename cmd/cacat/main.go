@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"flag"
 	"fmt"
-	"hash/adler32"
 	"io"
 	"os"
 	"path/filepath"
@@ -13,21 +12,17 @@ import (
 	"github.com/busoc/erdle"
 )
 
-var sumEmpty uint32
-
-func init() {
-	sumEmpty = adler32.Checksum(make([]byte, 1008))
-}
-
 func main() {
 	datadir := flag.String("d", os.TempDir(), "")
 	skip := flag.Int("s", 0, "strip N bytes before")
 	filler := flag.Bool("k", false, "keep filler")
 	repeat := flag.Int("n", 0, "repeat")
 	body := flag.Bool("b", false, "body only")
+	verify := flag.Bool("v", false, "verify crc and skip invalid cadus")
+	fill := flag.Uint("fill", 0, "byte of the body of fill frames")
 	flag.Parse()
 
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 || *fill > 0xFF {
 		os.Exit(2)
 	}
 	var files []string
@@ -50,21 +45,22 @@ func main() {
 	defer wc.Close()
 
 	for i, f := range files {
-		if s, err := copyFile(wc, f, *skip, *filler); err != nil {
+		if s, err := copyFile(wc, f, *skip, *filler, *verify, byte(*fill)); err != nil {
 			os.Exit(5)
 		} else {
-			fmt.Printf("%4d: %s: %d cadus (%dKB), %4d skipped\n", i+1, filepath.Base(f), s.Count, s.Size>>10, s.Skip)
+			fmt.Printf("%4d: %s: %d cadus (%dKB), %4d skipped, %4d invalid\n", i+1, filepath.Base(f), s.Count, s.Size>>10, s.Skip, s.Invalid)
 		}
 	}
 }
 
 type copyStat struct {
-	Count int
-	Size  int
-	Skip  int
+	Count   int
+	Size    int
+	Skip    int
+	Invalid int
 }
 
-func copyFile(w io.Writer, file string, skip int, fill bool) (copyStat, error) {
+func copyFile(w io.Writer, file string, skip int, keep, verify bool, fill byte) (copyStat, error) {
 	var stat copyStat
 	r, err := os.Open(file)
 	if err != nil {
@@ -81,10 +77,14 @@ func copyFile(w io.Writer, file string, skip int, fill bool) (copyStat, error) {
 		if err != nil {
 			return stat, err
 		}
-		if s := adler32.Checksum(body[skip+erdle.CaduHeaderLen : skip+erdle.CaduBodyLen]); !fill && s == sumEmpty {
+		if !keep && erdle.IsFillCadu(body[skip:], fill) {
 			stat.Skip++
 			continue
 		}
+		if verify && !validCadu(body[skip:]) {
+			stat.Invalid++
+			continue
+		}
 		if n, err := w.Write(body[skip:]); err != nil {
 			return stat, err
 		} else {
@@ -95,6 +95,11 @@ func copyFile(w io.Writer, file string, skip int, fill bool) (copyStat, error) {
 	return stat, nil
 }
 
+func validCadu(bs []byte) bool {
+	want := binary.BigEndian.Uint16(bs[erdle.CaduTrailerIndex:])
+	return want == erdle.Sum(bs[erdle.MagicLen:erdle.CaduTrailerIndex])
+}
+
 type writer struct {
 	body  bool
 	next  uint32
@@ -119,12 +124,11 @@ func (w *writer) Close() error {
 
 func (w *writer) Write(bs []byte) (int, error) {
 	if !w.body {
-		if n := (w.next & 0xFF000000) >> 8; n > 0 {
-			w.next = 0
-		}
-		binary.BigEndian.PutUint32(bs[6:], w.next<<8)
-		binary.BigEndian.PutUint16(bs[erdle.CaduBodyLen:], erdle.Sum(bs[erdle.MagicLen:erdle.CaduBodyLen]))
-		w.next++
+		// the counter of a cadu is only 24 bits: the lower byte of bs[6:10] is
+		// the signaling field that should be kept as is.
+		binary.BigEndian.PutUint32(bs[6:], w.next<<8|uint32(bs[9]))
+		binary.BigEndian.PutUint16(bs[erdle.CaduTrailerIndex:], erdle.Sum(bs[erdle.MagicLen:erdle.CaduTrailerIndex]))
+		w.next = (w.next + 1) & 0xFFFFFF
 	} else {
 		bs = bs[14:1022]
 	}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+func TestWriterCounterWrap(t *testing.T) {
+	var buf bytes.Buffer
+	w := writer{inner: bufio.NewWriter(&buf), next: erdle.CaduCounterMax - 1}
+	for i := 0; i < 3; i++ {
+		bs := erdletest.BuildCadu(uint32(i), 1, nil)
+		bs[9] = 0x5A
+		if _, err := w.Write(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.inner.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{erdle.CaduCounterMax - 1, erdle.CaduCounterMax, 0}
+	for i, c := range want {
+		bs := buf.Next(erdle.CaduLen)
+		if got := binary.BigEndian.Uint32(bs[6:]) >> 8; got != c {
+			t.Errorf("cadu %d: want counter %d, got %d", i+1, c, got)
+		}
+		if bs[9] != 0x5A {
+			t.Errorf("cadu %d: signaling field not kept (%02x)", i+1, bs[9])
+		}
+		if !validCadu(bs) {
+			t.Errorf("cadu %d: invalid crc", i+1)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/cmd/internal/multireader"
+	"github.com/busoc/vmu"
+)
+
+// benchResult is the outcome of one run of bench.
+type benchResult struct {
+	Cadus   int64
+	Packets int
+	Invalid int
+	Elapsed time.Duration
+	// Mallocs and Alloc are the number of allocations and the number of bytes
+	// allocated during the run.
+	Mallocs uint64
+	Alloc   uint64
+
+	skip int
+}
+
+func (b benchResult) perSecond(n float64) float64 {
+	if b.Elapsed <= 0 {
+		return 0
+	}
+	return n / b.Elapsed.Seconds()
+}
+
+func (b benchResult) CadusRate() float64 {
+	return b.perSecond(float64(b.Cadus))
+}
+
+func (b benchResult) PacketsRate() float64 {
+	return b.perSecond(float64(b.Packets))
+}
+
+// MBRate gives the number of megabytes of cadus (skipped bytes included) read
+// by second.
+func (b benchResult) MBRate() float64 {
+	return b.perSecond(float64(b.Cadus*int64(b.skip+CaduLen)) / (1 << 20))
+}
+
+// benchHRDL reads the cadus of files as fast as possible, reassembles their
+// HRDL packets, decodes their headers and verifies their checksum (as count
+// does). Corrupted cadus and packets are skipped.
+func benchHRDL(files []string, skip, limit int) (benchResult, error) {
+	b := benchResult{skip: skip}
+
+	r, err := multireader.New(files)
+	if err != nil {
+		return b, err
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	now := time.Now()
+	hr := HRDLReader(r, skip)
+	hr.SetLimit(limit)
+	for {
+		bs, err := hr.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsCRCError(err) || erdle.IsLengthError(err) || err == ErrTrailerMissing {
+			continue
+		}
+		if err != nil {
+			return b, err
+		}
+		b.Packets++
+		if _, err := erdle.DecodeHRDLHeader(bs); err != nil {
+			b.Invalid++
+			continue
+		}
+		if z := len(bs); z < minPacketLen || vmu.Sum(bs[8:z-4]) != binary.LittleEndian.Uint32(bs[z-4:]) {
+			b.Invalid++
+		}
+	}
+	b.Elapsed = time.Since(now)
+	b.Cadus = hr.inner.frames
+
+	runtime.ReadMemStats(&after)
+	b.Mallocs = after.Mallocs - before.Mallocs
+	b.Alloc = after.TotalAlloc - before.TotalAlloc
+	return b, nil
+}
+
+// benchFiles runs benchHRDL count times and prints the result of each run. If
+// there are several runs, the minimum, the median and the maximum of the rates
+// are printed at the end.
+func benchFiles(files []string, skip, limit, count int) error {
+	if count <= 0 {
+		count = 1
+	}
+	rs := make([]benchResult, 0, count)
+	for i := 1; i <= count; i++ {
+		b, err := benchHRDL(files, skip, limit)
+		if err != nil {
+			return err
+		}
+		log.Printf("run %d: %d cadus, %d packets (%d invalid) in %s: %.0f cadus/s, %.0f packets/s, %.2fMB/s, %d allocs (%dMB)", i, b.Cadus, b.Packets, b.Invalid, b.Elapsed, b.CadusRate(), b.PacketsRate(), b.MBRate(), b.Mallocs, b.Alloc>>20)
+		rs = append(rs, b)
+	}
+	if len(rs) < 2 {
+		return nil
+	}
+	report := func(name string, rate func(benchResult) float64) {
+		vs := make([]float64, len(rs))
+		for i, b := range rs {
+			vs[i] = rate(b)
+		}
+		sort.Float64s(vs)
+		log.Printf("%-9s min: %12.2f, median: %12.2f, max: %12.2f", name, vs[0], median(vs), vs[len(vs)-1])
+	}
+	report("cadus/s", benchResult.CadusRate)
+	report("packets/s", benchResult.PacketsRate)
+	report("MB/s", benchResult.MBRate)
+	return nil
+}
+
+// median gives the median of the sorted values vs.
+func median(vs []float64) float64 {
+	n := len(vs)
+	if n%2 == 1 {
+		return vs[n/2]
+	}
+	return (vs[n/2-1] + vs[n/2]) / 2
+}
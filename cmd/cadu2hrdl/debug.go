@@ -1,15 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"hash/adler32"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/busoc/erdle"
@@ -26,7 +30,7 @@ func byOrigin(bs []byte) (byte, uint32) {
 	return bs[39], binary.LittleEndian.Uint32(bs[19:])
 }
 
-func indexPackets(r io.Reader, by string) error {
+func indexPackets(r io.Reader, by string, fill byte) error {
 	var byFunc func(bs []byte) (byte, uint32, time.Time)
 
 	hdrLen := erdle.WordLen + VMULen
@@ -61,7 +65,6 @@ func indexPackets(r io.Reader, by string) error {
 		return fmt.Errorf("unrecognized value %s", by)
 	}
 	body := make([]byte, 1024)
-	sum := adler32.Checksum(body)
 
 	var (
 		buffer  []byte
@@ -84,7 +87,7 @@ func indexPackets(r io.Reader, by string) error {
 				return err
 			}
 		}
-		if s := adler32.Checksum(body); s == sum {
+		if erdle.IsFillCadu(body, fill) {
 			buffer = buffer[:0]
 			continue
 		}
@@ -117,35 +120,80 @@ func indexPackets(r io.Reader, by string) error {
 	return nil
 }
 
-func inspectCadus(rs io.Reader, skip int) error {
+// inspection holds the statistics computed by inspectCadus.
+type inspection struct {
+	mu sync.Mutex
+
+	Cadus   uint64
+	Size    uint64
+	Missing uint64
+	Invalid uint64
+	Filler  uint64
+	Packets uint64
+	Bytes   uint64
+}
+
+func (i *inspection) Merge(o *inspection) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.Cadus += o.Cadus
+	i.Size += o.Size
+	i.Missing += o.Missing
+	i.Invalid += o.Invalid
+	i.Filler += o.Filler
+	i.Packets += o.Packets
+	i.Bytes += o.Bytes
+}
+
+func (i *inspection) String() string {
+	const row = "%7d cadus (%3dKB), %8d missing, %4d invalid, %4d filler, %7d packets (avg: %4dKB, sum: %6dKB)"
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var avg uint64
+	if i.Packets > 0 {
+		avg = (i.Bytes / i.Packets) >> 10
+	}
+	return fmt.Sprintf(row, i.Cadus, i.Size>>10, i.Missing, i.Invalid, i.Filler, i.Packets, avg, i.Bytes>>10)
+}
+
+// inspectCadus computes statistics on the cadus read from rs and merges them
+// into total. Fill frames are detected with erdle.IsFillCadu and the given
+// pattern. If verbose is true, the statistics are also printed. If hist is
+// not nil, the distribution of the sizes of the HRDL packets is merged into
+// hist (and printed with verbose).
+func inspectCadus(rs io.Reader, skip int, fill byte, hist *histogram, total *inspection, verbose bool) error {
 	var (
+		sizes   histogram
 		size    uint64
 		average uint64
 		filler  uint64
 		prefix  uint64
 		missing uint64
 		invalid uint64
-		total   uint64
+		count   uint64
 		hrdl    uint64
 		buffer  []byte
 	)
 
-	r := erdle.CaduReader(rs, skip)
-	body := make([]byte, 1008)
-	sum := adler32.Checksum(body)
+	r := erdle.VCDUReader(rs, skip)
+	frame := make([]byte, erdle.CaduLen)
+	body := frame[erdle.CaduHeaderLen:erdle.CaduTrailerIndex]
 	for {
-		n, err := r.Read(body)
-		size += uint64(n)
+		n, err := r.Read(frame)
 		if n > 0 {
-			total++
+			size += uint64(len(body))
+			count++
 		}
 		if err == io.EOF {
 			break
 		}
 		if err == nil {
-			if sum == adler32.Checksum(body) {
+			if erdle.IsFillCadu(frame, fill) {
 				filler++
-				size -= uint64(n)
+				size -= uint64(len(body))
 				continue
 			}
 			var offset int
@@ -155,7 +203,9 @@ func inspectCadus(rs io.Reader, skip int) error {
 				prefix++
 				hrdl++
 
-				average += uint64(binary.LittleEndian.Uint32(body[erdle.WordLen:]))
+				z := uint64(binary.LittleEndian.Uint32(body[erdle.WordLen:]))
+				average += z
+				sizes.Add(z)
 			}
 			buffer = append(buffer, body...)
 			for offset < len(buffer) {
@@ -165,7 +215,9 @@ func inspectCadus(rs io.Reader, skip int) error {
 				} else {
 					hrdl++
 					if len(buffer[offset+ix:]) >= 8 {
-						average += uint64(binary.LittleEndian.Uint32(buffer[offset+ix+erdle.WordLen:]))
+						z := uint64(binary.LittleEndian.Uint32(buffer[offset+ix+erdle.WordLen:]))
+						average += z
+						sizes.Add(z)
 					}
 					offset = offset + ix + erdle.WordLen
 				}
@@ -178,17 +230,140 @@ func inspectCadus(rs io.Reader, skip int) error {
 			return err
 		}
 	}
-	const row = "%7d cadus (%3dKB), %8d missing, %4d invalid, %4d filler, %7d packets (avg: %4dKB, sum: %6dKB)"
-	var avg uint64
-	if hrdl > 0 {
-		avg = (average / hrdl) >> 10
+	i := inspection{
+		Cadus:   count,
+		Size:    size,
+		Missing: missing,
+		Invalid: invalid,
+		Filler:  filler,
+		Packets: hrdl,
+		Bytes:   average,
+	}
+	if verbose {
+		log.Print(i.String())
+	}
+	if total != nil {
+		total.Merge(&i)
+	}
+	if hist != nil {
+		if verbose {
+			log.Printf("histogram: %s", sizes.String())
+		}
+		hist.Merge(&sizes)
 	}
-	log.Printf(row, total, size>>10, missing, invalid, filler, hrdl, avg, average>>10)
 	return nil
 }
 
-func replayCadus(addr string, r io.Reader, rate int) (*coze, error) {
-	c, err := net.Dial(protoFromAddr(addr))
+var sizeBuckets = [...]struct {
+	Limit uint64
+	Label string
+}{
+	{Limit: 1 << 10, Label: "<1K"},
+	{Limit: 4 << 10, Label: "1-4K"},
+	{Limit: 16 << 10, Label: "4-16K"},
+	{Limit: 64 << 10, Label: "16-64K"},
+	{Limit: 256 << 10, Label: "64-256K"},
+	{Limit: 1 << 20, Label: "256K-1M"},
+}
+
+type histogram struct {
+	mu sync.Mutex
+	// the last count is for the sizes above the limit of the last bucket.
+	counts [len(sizeBuckets) + 1]uint64
+}
+
+func (h *histogram) Add(size uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range sizeBuckets {
+		if size < b.Limit {
+			h.counts[i]++
+			return
+		}
+	}
+	h.counts[len(sizeBuckets)]++
+}
+
+func (h *histogram) Merge(o *histogram) {
+	o.mu.Lock()
+	cs := o.counts
+	o.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range cs {
+		h.counts[i] += cs[i]
+	}
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var str strings.Builder
+	for i, b := range sizeBuckets {
+		fmt.Fprintf(&str, "%s: %d, ", b.Label, h.counts[i])
+	}
+	fmt.Fprintf(&str, ">=1M: %d", h.counts[len(sizeBuckets)])
+	return str.String()
+}
+
+// rawFrame gives the cadus read from r as they are, without checking their
+// magic, their CRC nor their counter. The skip bytes before each cadu are
+// dropped.
+type rawFrame struct {
+	inner io.Reader
+	skip  int
+	frame []byte
+	rest  []byte
+}
+
+func rawFrames(r io.Reader, skip int) io.Reader {
+	return &rawFrame{
+		inner: r,
+		skip:  skip,
+		frame: make([]byte, skip+erdle.CaduLen),
+	}
+}
+
+func (r *rawFrame) Read(bs []byte) (int, error) {
+	if len(r.rest) == 0 {
+		if _, err := io.ReadFull(r.inner, r.frame); err != nil {
+			return 0, err
+		}
+		r.rest = r.frame[r.skip:]
+	}
+	n := copy(bs, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// replayFaults gives the probabilities of the errors injected in the cadus
+// sent by replay: Drop to not send a cadu (creating a gap in the counter) and
+// Corrupt to flip a byte of its body (breaking its CRC).
+type replayFaults struct {
+	Drop    float64
+	Corrupt float64
+}
+
+// Inject applies the faults to the cadu bs (modified in place). It reports
+// whether bs should be dropped and whether it has been corrupted.
+func (f replayFaults) Inject(bs []byte) (bool, bool) {
+	if f.Drop > 0 && rand.Float64() < f.Drop {
+		return true, false
+	}
+	if f.Corrupt > 0 && rand.Float64() < f.Corrupt {
+		bs[erdle.CaduHeaderLen+rand.Intn(erdle.CaduBodyLen)] ^= 0xFF
+		return false, true
+	}
+	return false, false
+}
+
+// replayCadus sends the cadus read from r to addr. The cadus dropped and the
+// cadus corrupted by faults are counted as missing and as invalid.
+func replayCadus(addr string, r io.Reader, rate int, cfg *tls.Config, faults replayFaults) (*coze, error) {
+	c, err := dial(addr, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -203,24 +378,38 @@ func replayCadus(addr string, r io.Reader, rate int) (*coze, error) {
 
 	tick := time.Tick(time.Second)
 	logger := log.New(os.Stderr, "[replay] ", 0)
+	if rate > 0 {
+		logger.Printf("target rate: %.2fMbps", mbps(rate, time.Second))
+	}
 
 	var (
 		size, count int
 		z           coze
+		frame       = make([]byte, erdle.CaduLen)
 	)
+	rand.Seed(time.Now().UnixNano())
 	for {
-		if n, err := io.CopyN(w, r, 1024); err != nil {
-			if err == io.EOF {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
 			return nil, err
+		}
+		drop, corrupt := faults.Inject(frame)
+		if corrupt {
+			z.Invalid++
+		}
+		if drop {
+			z.Missing++
+		} else if n, err := w.Write(frame); err != nil {
+			return nil, err
 		} else {
-			size += int(n)
+			size += n
 			count++
 		}
 		select {
 		case <-tick:
-			logger.Printf("%6d packets, %dKB", count, size>>10)
+			logger.Printf("%6d packets, %dKB, %.2fMbps", count, size>>10, mbps(size, time.Second))
 			z.Count += count
 			z.Size += size
 			size, count = 0, 0
@@ -232,14 +421,36 @@ func replayCadus(addr string, r io.Reader, rate int) (*coze, error) {
 	return &z, nil
 }
 
-func traceCadus(addr string) error {
-	c, err := listenUDP(addr)
+// mbps gives the bitrate (in megabits per second) of n bytes transferred in
+// elapsed.
+func mbps(n int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n*8) / elapsed.Seconds() / 1e6
+}
+
+// gapAlert is the event pushed to the clients of the trace command when a gap
+// larger than the configured threshold is detected.
+type gapAlert struct {
+	When    time.Time `json:"ts"`
+	Channel uint8     `json:"vc"`
+	From    uint32    `json:"from"`
+	To      uint32    `json:"to"`
+	Missing uint32    `json:"missing"`
+}
+
+// traceCadus reports every second statistics on the cadus received on addr. If
+// frames is not nil, an event is also given to frames for each cadu received.
+// If alerts is not nil, a gapAlert is published to it for every gap of more
+// than threshold cadus.
+func traceCadus(addr string, buffer int, logger, frames Logger, alerts *broker, threshold uint32) error {
+	c, err := listenUDP(addr, buffer)
 	if err != nil {
 		return err
 	}
 
 	tick := time.Tick(time.Second)
-	logger := log.New(os.Stderr, "[debug] ", 0)
 
 	rg := ringbuffer.NewRingSize(64<<20, 8<<20)
 	go func() {
@@ -251,7 +462,9 @@ func traceCadus(addr string) error {
 		errSize  int
 		errMagic int
 		missing  uint32
-		prev     uint32
+		// each virtual channel has its own counter
+		prevs    = make(map[uint8]uint32)
+		channels = make(channelCounts)
 	)
 	body := make([]byte, 1024)
 	for {
@@ -266,49 +479,159 @@ func traceCadus(addr string) error {
 		case !bytes.Equal(body[:4], erdle.Magic):
 			errMagic++
 		}
-		curr := binary.BigEndian.Uint32(body[6:]) >> 8
-		if diff := (curr - prev) & 0xFFFFFF; curr != diff && diff > 1 {
+		var gap uint32
+		vc, curr := body[5]&0x3F, binary.BigEndian.Uint32(body[6:])>>8
+		prev, seen := prevs[vc]
+		if diff := (curr - prev) & 0xFFFFFF; seen && diff > 1 {
+			gap = diff
 			missing += diff
+			channels[vc] += diff
+			if alerts != nil && diff > threshold {
+				a := gapAlert{
+					When:    time.Now().UTC(),
+					Channel: vc,
+					From:    prev,
+					To:      curr,
+					Missing: diff,
+				}
+				if bs, err := json.Marshal(a); err == nil {
+					alerts.Publish(bs)
+				}
+			}
+		}
+		prevs[vc] = curr
+		if _, ok := channels[vc]; !ok {
+			channels[vc] = 0
+		}
+		if frames != nil {
+			frames.Log("%8d | %8d | %4d", Field{"counter", curr}, Field{"gap", gap}, Field{"size", n})
 		}
-		prev = curr
 
 		count++
 		size += n
 		select {
 		case <-tick:
-			logger.Printf("%6d packets, %8d missing, %8d size error, %8d magic error, %6dKB", count, missing, errSize, errMagic, size)
+			logger.Log("%6d packets, %8d missing, %8d size error, %8d magic error, %6dKB, missing by channel: %s",
+				Field{"packets", count},
+				Field{"missing", missing},
+				Field{"size_error", errSize},
+				Field{"magic_error", errMagic},
+				Field{"bytes", size},
+				Field{"channels", channels},
+			)
 			count, size, missing, errSize, errMagic = 0, 0, 0, 0, 0
+			channels = make(channelCounts)
 		default:
 		}
 	}
 	return nil
 }
 
-func dumpPackets(queue <-chan []byte, i int) error {
+// channelCounts are the cadus missing by virtual channel.
+type channelCounts map[uint8]uint32
+
+func (c channelCounts) String() string {
+	vs := make([]int, 0, len(c))
+	for v := range c {
+		vs = append(vs, int(v))
+	}
+	sort.Ints(vs)
+
+	var str []string
+	for _, v := range vs {
+		str = append(str, fmt.Sprintf("%02x=%d", v, c[uint8(v)]))
+	}
+	if len(str) == 0 {
+		return "-"
+	}
+	return strings.Join(str, " ")
+}
+
+// correlator compares the gaps in the sequence counters of the HRDL packets of
+// a channel with the cadus missing since the previous packet of this channel. A
+// gap in the sequence counter without missing cadus points to a reassembly
+// issue while missing cadus with a gap point to a loss in the downlink.
+//
+// Cadus are missing when the first cadu of a packet does not follow the last
+// cadu of the previous packet (of any channel). Fill frames between packets are
+// also counted as missing.
+type correlator struct {
+	started bool
+	last    uint32
+	missing uint32
+
+	sequences map[byte]uint32
+	marks     map[byte]uint32
+}
+
+func newCorrelator() *correlator {
+	return &correlator{
+		sequences: make(map[byte]uint32),
+		marks:     make(map[byte]uint32),
+	}
+}
+
+// Update gives the delta of the sequence counter and the number of cadus
+// missing since the previous packet of channel and a flag telling if they
+// agree.
+func (c *correlator) Update(p packet, channel byte, seq uint32) (uint32, uint32, string) {
+	if c.started {
+		if d := (p.First - c.last) & erdle.CaduCounterMask; d > 1 && d < erdle.CaduCounterMask/2 {
+			c.missing += d - 1
+		}
+	}
+	c.started, c.last = true, p.Last
+
+	prev, ok := c.sequences[channel]
+	c.sequences[channel] = seq
+	if !ok {
+		c.marks[channel] = c.missing
+		return 0, 0, "-"
+	}
+	delta, cadus := seq-prev, c.missing-c.marks[channel]
+	c.marks[channel] = c.missing
+
+	switch gap := delta > 1; {
+	case gap && cadus == 0:
+		return delta, cadus, "hrdl"
+	case !gap && cadus > 0:
+		return delta, cadus, "cadu"
+	case gap:
+		return delta, cadus, "loss"
+	default:
+		return delta, cadus, "-"
+	}
+}
+
+// dumpPackets prints the packets received from queue. If verbose is true, the
+// counters of the first and last cadus used to reassemble the packets are also
+// printed. If correlate is true, the delta of the sequence counter and the
+// cadus missing since the previous packet of the same channel are also printed
+// (see correlator). If lat is not nil, the delay between the acquisition time
+// of each packet and the time it is read from queue is printed too. It returns
+// once the limit of sp is reached.
+func dumpPackets(queue <-chan packet, i int, verbose, correlate bool, sp sampling, lat *latency) error {
 	var kind, instance string
 	switch i {
 	case 0, 1, 2, 255:
-		kind = "HDK"
-		switch i {
-		case 0:
-			instance = "TEST"
-		case 1, 2:
-			instance = fmt.Sprintf("SIM%d", i)
-		case 255:
-			instance = "OPS"
-		}
+		kind, instance = "HDK", strings.ToUpper(instanceNames[i])
 	case -1:
 		kind, instance = "HRDL", "-"
 	default:
-		return fmt.Errorf("unsupported instance %d", i)
+		return checkInstance(i)
 	}
 	ps := make(map[byte]uint32)
+	cr := newCorrelator()
+	if lat != nil {
+		defer func() { log.Print(lat) }()
+	}
 
 	for i := 1; ; i++ {
-		bs, ok := <-queue
+		p, ok := <-queue
 		if !ok {
 			return nil
 		}
+		bs := p.Data
 		var missing uint32
 
 		c := bs[0]
@@ -322,18 +645,42 @@ func dumpPackets(queue <-chan []byte, i int) error {
 			chk += uint32(bs[i])
 		}
 		sum := binary.LittleEndian.Uint32(bs[len(bs)-4:])
-		log.Printf("%5s | %5s | %7d | %8d | %7d | %12d | %x | %08x | %08x", kind, instance, i, len(bs)-4, curr, missing, bs[:16], sum, chk)
+		var extra string
+		if correlate {
+			delta, cadus, flag := cr.Update(p, c, curr)
+			extra = fmt.Sprintf(" | %6d | %6d | %4s", delta, cadus, flag)
+		}
+		if lat != nil {
+			// packets are received as soon as they are reassembled
+			if d, ok := lat.Update(bs, time.Now()); ok {
+				extra += fmt.Sprintf(" | %12s", d.Round(time.Millisecond))
+			} else {
+				extra += fmt.Sprintf(" | %12s", "-")
+			}
+		}
+		if verbose {
+			log.Printf("%5s | %5s | %7d | %8d | %7d | %12d | %8d | %8d | %x | %08x | %08x%s", kind, instance, i, len(bs)-4, curr, missing, p.First, p.Last, bs[:16], sum, chk, extra)
+		} else {
+			log.Printf("%5s | %5s | %7d | %8d | %7d | %12d | %x | %08x | %08x%s", kind, instance, i, len(bs)-4, curr, missing, bs[:16], sum, chk, extra)
+		}
+		if sp.Done(sum == chk) {
+			return nil
+		}
 	}
 	return nil
 }
 
-func debugHRDL(a string, n, i int) (<-chan []byte, error) {
-	c, err := net.Listen(protoFromAddr(a))
+// debugHRDL accepts connections on a and gives the HRDL packets they send. At
+// most p connections are read at the same time, the others wait for one of them
+// to be closed.
+func debugHRDL(a string, n, i, p int, cfg *tls.Config) (<-chan packet, error) {
+	c, err := listen(a, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	q := make(chan []byte, n)
+	q := make(chan packet, n)
+	rs := newReaderPool(p, 8<<20)
 	go func() {
 		defer func() {
 			close(q)
@@ -346,7 +693,8 @@ func debugHRDL(a string, n, i int) (<-chan []byte, error) {
 			}
 			go func(c net.Conn) {
 				defer c.Close()
-				r := bufio.NewReaderSize(c, 8<<20)
+				r := rs.Get(c)
+				defer rs.Put(r)
 
 				var size uint32
 				for {
@@ -358,7 +706,7 @@ func debugHRDL(a string, n, i int) (<-chan []byte, error) {
 						return
 					}
 					select {
-					case q <- bs:
+					case q <- packet{Data: bs}:
 					default:
 					}
 				}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestHistogram(t *testing.T) {
+	var h, sizes histogram
+	// a packet of exactly 1M is counted with the larger ones
+	for _, z := range []uint64{10, 2 << 10, 100 << 10, 1 << 20, 12 << 20} {
+		sizes.Add(z)
+	}
+	h.Merge(&sizes)
+	h.Merge(&sizes)
+
+	want := "<1K: 2, 1-4K: 2, 4-16K: 0, 16-64K: 0, 64-256K: 2, 256K-1M: 0, >=1M: 4"
+	if got := h.String(); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/vmu"
+)
+
+// packetKey identifies an HRDL packet in a stream.
+type packetKey struct {
+	Channel  uint8
+	Sequence uint32
+}
+
+// packetDigest summarizes the content of an HRDL packet. Only the digest of
+// the packets of the first stream are kept in memory.
+type packetDigest struct {
+	Sum    uint32
+	Digest uint64
+}
+
+// diffHRDL compares the HRDL packets reassembled from a and b. Packets are
+// matched by their channel and sequence counter. If verbose is true, each
+// packet that is missing in one of the streams or that differs is printed.
+func diffHRDL(a, b io.Reader, verbose bool) error {
+	ps := make(map[packetKey]packetDigest)
+	err := digestHRDL(a, func(k packetKey, d packetDigest) {
+		ps[k] = d
+	})
+	if err != nil {
+		return err
+	}
+
+	var same, differ, onlyB int
+	err = digestHRDL(b, func(k packetKey, d packetDigest) {
+		other, ok := ps[k]
+		switch {
+		case !ok:
+			onlyB++
+			if verbose {
+				log.Printf("%-6s | %02x | %8d | %08x | %8s", "B only", k.Channel, k.Sequence, d.Sum, "-")
+			}
+			return
+		case other != d:
+			differ++
+			if verbose {
+				log.Printf("%-6s | %02x | %8d | %08x | %08x", "differ", k.Channel, k.Sequence, other.Sum, d.Sum)
+			}
+		default:
+			same++
+		}
+		delete(ps, k)
+	})
+	if err != nil {
+		return err
+	}
+	if verbose {
+		ks := make([]packetKey, 0, len(ps))
+		for k := range ps {
+			ks = append(ks, k)
+		}
+		sort.Slice(ks, func(i, j int) bool {
+			if ks[i].Channel == ks[j].Channel {
+				return ks[i].Sequence < ks[j].Sequence
+			}
+			return ks[i].Channel < ks[j].Channel
+		})
+		for _, k := range ks {
+			log.Printf("%-6s | %02x | %8d | %8s | %08x", "A only", k.Channel, k.Sequence, "-", ps[k].Sum)
+		}
+	}
+	log.Printf("%d identical packets, %d different, %d only in A, %d only in B", same, differ, len(ps), onlyB)
+	return nil
+}
+
+// digestHRDL gives to fn the key and the digest of each HRDL packet read from
+// r. Packets that can not be reassembled or decoded are skipped.
+func digestHRDL(r io.Reader, fn func(packetKey, packetDigest)) error {
+	body := make([]byte, vmu.BufferSize)
+	for {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsCRCError(err) || erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				continue
+			}
+			return err
+		}
+		if n < erdle.WordLen+erdle.HRDLSizeLen {
+			continue
+		}
+		z := int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12
+		if z > n {
+			continue
+		}
+		h, err := erdle.DecodeHRDLHeader(body[:z])
+		if err != nil {
+			continue
+		}
+		s := fnv.New64a()
+		s.Write(body[erdle.WordLen+erdle.HRDLSizeLen : z-erdle.HRDLTrailerLen])
+
+		k := packetKey{Channel: h.Channel, Sequence: h.Sequence}
+		fn(k, packetDigest{
+			Sum:    binary.LittleEndian.Uint32(body[z-erdle.HRDLTrailerLen:]),
+			Digest: s.Sum64(),
+		})
+	}
+}
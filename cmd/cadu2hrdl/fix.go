@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/busoc/erdle"
+)
+
+// fixStats gives the number of cadus written by fixCadus, how many of them had
+// an invalid CRC and how many of them have been renumbered.
+type fixStats struct {
+	Count      int
+	CRC        int
+	Renumbered int
+}
+
+// fixCadus copies the cadus read from r to w (with the skip bytes preceding
+// them) and writes a correct CRC in each of them. If renumber is true, the
+// counters of the cadus of each virtual channel are rewritten to be sequential
+// (starting at 0). Unlike cacat, no cadus are dropped.
+func fixCadus(r io.Reader, w io.Writer, skip int, renumber bool) (fixStats, error) {
+	var (
+		st       fixStats
+		frame    = make([]byte, skip+erdle.CaduLen)
+		counters = make(map[uint8]uint32)
+		ws       = bufio.NewWriter(w)
+	)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return st, err
+		}
+		bs := frame[skip:]
+		if !bytes.HasPrefix(bs, erdle.Magic) {
+			return st, erdle.ErrMagic
+		}
+		want := binary.BigEndian.Uint16(bs[erdle.CaduTrailerIndex:])
+		if erdle.Sum(bs[erdle.MagicLen:erdle.CaduTrailerIndex]) != want {
+			st.CRC++
+		}
+		if renumber {
+			vc := bs[5] & 0x3F
+			curr := binary.BigEndian.Uint32(bs[6:]) >> 8
+			if next := counters[vc]; curr != next {
+				// the lower byte is the signaling field that is kept as is.
+				binary.BigEndian.PutUint32(bs[6:], next<<8|uint32(bs[9]))
+				st.Renumbered++
+			}
+			counters[vc] = (counters[vc] + 1) & erdle.CaduCounterMask
+		}
+		binary.BigEndian.PutUint16(bs[erdle.CaduTrailerIndex:], erdle.Sum(bs[erdle.MagicLen:erdle.CaduTrailerIndex]))
+		if _, err := ws.Write(frame); err != nil {
+			return st, err
+		}
+		st.Count++
+	}
+	return st, ws.Flush()
+}
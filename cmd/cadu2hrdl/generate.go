@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/juju/ratelimit"
+)
+
+type generateOptions struct {
+	Rate    int
+	Channel uint8
+	Count   int
+	Size    int
+	Gaps    float64
+	Corrupt float64
+}
+
+// generateCadus writes to w a stream of valid cadus carrying synthetic HRDL
+// packets. Cadus are dropped (creating a gap in the counter) with the
+// probability given by Gaps and their CRC is corrupted with the probability
+// given by Corrupt. Generation stops after Count cadus (including the ones
+// dropped) or never if Count is not positive.
+func generateCadus(w io.Writer, opts generateOptions) (*coze, error) {
+	if opts.Rate > 0 {
+		w = ratelimit.Writer(w, ratelimit.NewBucketWithRate(float64(opts.Rate), int64(opts.Rate)))
+	}
+	var (
+		buf     bytes.Buffer
+		z       coze
+		counter uint32
+		seq     uint32
+		payload = make([]byte, opts.Size)
+	)
+	rand.Seed(time.Now().UnixNano())
+	for i := 0; opts.Count <= 0 || i < opts.Count; i++ {
+		for buf.Len() < erdle.CaduBodyLen {
+			rand.Read(payload)
+			h := erdle.HRDLHeader{
+				Channel:  opts.Channel,
+				Sequence: seq,
+				When:     time.Now(),
+				Property: erdle.TypeScience << 4,
+				Counter:  seq,
+				Acqtime:  time.Now(),
+				UPI:      "SYNTHETIC",
+			}
+			buf.Write(erdle.EncodeHRDL(h, payload))
+			seq++
+		}
+		bs := erdle.EncodeCadu(counter, opts.Channel, buf.Next(erdle.CaduBodyLen))
+		counter = (counter + 1) & erdle.CaduCounterMask
+
+		if opts.Gaps > 0 && rand.Float64() < opts.Gaps {
+			z.Missing++
+			continue
+		}
+		if opts.Corrupt > 0 && rand.Float64() < opts.Corrupt {
+			crc := binary.BigEndian.Uint16(bs[erdle.CaduTrailerIndex:])
+			binary.BigEndian.PutUint16(bs[erdle.CaduTrailerIndex:], ^crc)
+			z.Invalid++
+		}
+		if _, err := w.Write(bs); err != nil {
+			return nil, err
+		}
+		z.Count++
+		z.Size += len(bs)
+	}
+	return &z, nil
+}
+
+// openTarget opens the UDP address (given as udp://host:port) or the file
+// where the generated cadus are written.
+func openTarget(a string) (io.WriteCloser, error) {
+	if proto, _ := protoFromAddr(a); proto == "udp" {
+		return dial(a, nil)
+	}
+	return os.Create(a)
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"text/template"
 	"time"
 
+	"github.com/busoc/erdle"
 	"github.com/busoc/timutil"
 	"github.com/midbel/roll"
 )
@@ -18,28 +21,299 @@ type Writer interface {
 	Filename() string
 }
 
-func NewWriter(dir string, payload uint8, options []roll.Option) (Writer, error) {
+const DefaultLayout = `{{printf "%04d" .Year}}/{{printf "%03d" .DayOfYear}}/{{printf "%02d" .Hour}}/rt_{{printf "%06d" .Seq}}_{{.Time.Format "150405"}}.dat`
+
+type layout struct {
+	datadir string
+	payload uint8
+	tpl     *template.Template
+}
+
+func newLayout(dir, pattern string, payload uint8) (*layout, error) {
+	if pattern == "" {
+		pattern = DefaultLayout
+	}
+	t, err := template.New("layout").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	y := layout{
+		datadir: dir,
+		payload: payload,
+		tpl:     t,
+	}
+	if _, err := y.Filename(0, time.Now()); err != nil {
+		return nil, err
+	}
+	return &y, nil
+}
+
+func (y *layout) Filename(n int, w time.Time) (string, error) {
+	data := struct {
+		Year      int
+		DayOfYear int
+		Hour      int
+		Seq       int
+		Time      time.Time
+		Payload   uint8
+	}{
+		Year:      w.Year(),
+		DayOfYear: w.YearDay(),
+		Hour:      w.Hour(),
+		Seq:       n,
+		Time:      w,
+		Payload:   y.payload,
+	}
+	var buf bytes.Buffer
+	if err := y.tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return filepath.Join(y.datadir, filepath.FromSlash(buf.String())), nil
+}
+
+func (y *layout) Create(n int, w time.Time) (string, error) {
+	file, err := y.Filename(n, w)
+	if err != nil {
+		return "", err
+	}
+	return file, os.MkdirAll(filepath.Dir(file), 0755)
+}
+
+// NewWriter creates the Writer of HRDFE files (payload is 0) or of HRDP files.
+// If closed is not nil, it is called with the name of each file once it has
+// been closed (when the writer rolls to a new file or is closed).
+//
+// If syncEvery is positive, the files are synced on disk (see os.File.Sync)
+// every syncEvery packets so that a crash loses at most the last syncEvery
+// packets. Each sync waits for the disk: the lower syncEvery, the lower the
+// throughput of the writer (and the compression ratio of compressed files that
+// are flushed before each sync).
+func NewWriter(dir, pattern string, payload uint8, compress bool, syncEvery int, closed func(string), options []roll.Option) (Writer, error) {
 	if payload == 0 {
-		return NewHRDFE(dir, options)
+		return NewHRDFE(dir, pattern, compress, syncEvery, closed, options)
 	} else {
-		return NewHRDP(dir, payload, options)
+		return NewHRDP(dir, pattern, payload, compress, syncEvery, closed, options)
 	}
 }
 
-type hrdfe struct {
-	datadir  string
+// discardWriter is the Writer used by store in dry run mode. Packets are
+// accepted but never written.
+type discardWriter struct{}
+
+func (discardWriter) Write(bs []byte) (int, error) { return len(bs), nil }
+func (discardWriter) Close() error                 { return nil }
+func (discardWriter) Filename() string             { return "dry-run" }
+
+// gzipFile creates the gzip stream only when the first bytes are written so
+// that a file without packets keeps a size of zero and can be removed.
+type gzipFile struct {
+	file   *os.File
+	writer *gzip.Writer
+}
+
+// openFile opens file to append packets to it. If syncEvery is positive, the
+// file is synced every syncEvery writes (see NewWriter).
+func openFile(file string, compress bool, syncEvery int) (io.WriteCloser, error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var wc io.WriteCloser = f
+	if compress {
+		wc = &gzipFile{file: f}
+	}
+	if syncEvery > 0 {
+		wc = &syncFile{WriteCloser: wc, file: f, every: syncEvery}
+	}
+	return wc, nil
+}
+
+func (g *gzipFile) Write(bs []byte) (int, error) {
+	if g.writer == nil {
+		g.writer = gzip.NewWriter(g.file)
+	}
+	return g.writer.Write(bs)
+}
+
+// Flush writes the data compressed so far to the file.
+func (g *gzipFile) Flush() error {
+	if g.writer == nil {
+		return nil
+	}
+	return g.writer.Flush()
+}
+
+func (g *gzipFile) Close() error {
+	var err error
+	if g.writer != nil {
+		err = g.writer.Close()
+	}
+	if e := g.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// syncFile syncs file on disk once every writes have been done. If the writer
+// of the file buffers its data (as gzipFile), it is flushed before.
+type syncFile struct {
+	io.WriteCloser
+	file  *os.File
+	every int
+	count int
+}
+
+func (s *syncFile) Write(bs []byte) (int, error) {
+	n, err := s.WriteCloser.Write(bs)
+	if err != nil {
+		return n, err
+	}
+	if s.count++; s.count < s.every {
+		return n, nil
+	}
+	s.count = 0
+	if f, ok := s.WriteCloser.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, s.file.Sync()
+}
+
+type rollFile struct {
+	mu       sync.Mutex
+	layout   *layout
 	filename string
+	compress bool
+	sync     int
+	manifest manifest
+	closed   func(string)
+	// pending is the packet being written (see write).
+	pending manifestEntry
+
+	// Clock gives the reception time written with each packet. time.Now is
+	// used when it is nil.
+	Clock func() time.Time
+}
+
+func (r *rollFile) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock()
+}
+
+// manifestEntry describes a packet to record in a manifest.
+type manifestEntry struct {
+	channel uint8
+	when    time.Time
+	size    int
+}
+
+// manifestFile records the pending packet in the manifest of its file once it
+// has been written. Since the files are rotated by the writer that calls Write,
+// the packet can not be recorded in the manifest of another file.
+type manifestFile struct {
+	io.WriteCloser
+	manifest *manifest
+	pending  *manifestEntry
+}
+
+func (m *manifestFile) Write(bs []byte) (int, error) {
+	n, err := m.WriteCloser.Write(bs)
+	if err == nil {
+		m.manifest.Update(m.pending.channel, m.pending.when, m.pending.size)
+	}
+	return n, err
+}
+
+// notifyCloser calls fn with the name of its file once it is closed.
+type notifyCloser struct {
+	io.WriteCloser
+	file string
+	fn   func(string)
+}
+
+func (n *notifyCloser) Close() error {
+	err := n.WriteCloser.Close()
+	if err == nil {
+		n.fn(n.file)
+	}
+	return err
+}
+
+func (r *rollFile) Filename() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.filename
+}
+
+func (r *rollFile) Open(n int, w time.Time) (io.WriteCloser, []io.Closer, error) {
+	file, err := r.layout.Create(n, w)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.compress {
+		file += ".gz"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.manifest.Flush(); err != nil {
+		return nil, nil, err
+	}
+	removeEmpty(file, r.filename)
+
+	r.filename = file
+	r.manifest.Reset(file)
+	wc, err := openFile(file, r.compress, r.sync)
+	if err != nil {
+		return nil, nil, err
+	}
+	wc = &manifestFile{WriteCloser: wc, manifest: &r.manifest, pending: &r.pending}
+	if r.closed != nil {
+		wc = &notifyCloser{WriteCloser: wc, file: file, fn: r.closed}
+	}
+	return wc, nil, nil
+}
+
+// write writes bs with wc (the writer rotating the files) and records the
+// packet in the manifest of the file it has been written to.
+func (r *rollFile) write(wc io.Writer, bs []byte, e manifestEntry) error {
+	r.pending = e
+	_, err := wc.Write(bs)
+	return err
+}
+
+func (r *rollFile) close(wc io.Closer) error {
+	err := wc.Close()
+	if e := r.manifest.Flush(); err == nil {
+		err = e
+	}
+	return err
+}
 
+type hrdfe struct {
+	rollFile
 	io.WriteCloser
 }
 
-func NewHRDFE(dir string, options []roll.Option) (Writer, error) {
+func NewHRDFE(dir, pattern string, compress bool, syncEvery int, closed func(string), options []roll.Option) (Writer, error) {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	y, err := newLayout(dir, pattern, 0)
+	if err != nil {
+		return nil, err
+	}
 	hr := hrdfe{
-		datadir: dir,
+		rollFile: rollFile{
+			layout:   y,
+			compress: compress,
+			sync:     syncEvery,
+			closed:   closed,
+		},
 	}
 	if hr.WriteCloser, err = roll.Roll(hr.Open, options...); err != nil {
 		return nil, err
@@ -47,53 +321,49 @@ func NewHRDFE(dir string, options []roll.Option) (Writer, error) {
 	return &hr, nil
 }
 
-func (h *hrdfe) Filename() string {
-	return h.filename
-}
-
-func (h *hrdfe) Open(n int, w time.Time) (io.WriteCloser, []io.Closer, error) {
-	datadir, err := mkdirAll(h.datadir, w)
-	if err != nil {
-		return nil, nil, err
-	}
-	file := filepath.Join(datadir, fmt.Sprintf("rt_%06d_%s.dat", n, w.Format("150405")))
-	go removeEmpty(file, h.filename)
-
-	h.filename = file
-	wc, err := os.OpenFile(h.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	return wc, nil, err
+func (h *hrdfe) Close() error {
+	return h.close(h.WriteCloser)
 }
 
 func (h *hrdfe) Write(bs []byte) (int, error) {
 	var buf bytes.Buffer
 
-	n := time.Now()
+	n := h.now()
 	binary.Write(&buf, binary.BigEndian, uint32(n.Unix()))
 	binary.Write(&buf, binary.BigEndian, uint32(0))
 	buf.Write(bs)
 
-	if _, err := h.WriteCloser.Write(buf.Bytes()); err != nil {
+	e := manifestEntry{channel: bs[5] & 0x3F, when: n, size: len(bs)}
+	if err := h.write(h.WriteCloser, buf.Bytes(), e); err != nil {
 		return 0, err
 	}
 	return len(bs), nil
 }
 
 type hrdp struct {
-	datadir  string
-	filename string
-	payload  uint8
+	rollFile
+	payload uint8
 
 	io.WriteCloser
 }
 
-func NewHRDP(dir string, payload uint8, options []roll.Option) (Writer, error) {
+func NewHRDP(dir, pattern string, payload uint8, compress bool, syncEvery int, closed func(string), options []roll.Option) (Writer, error) {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	y, err := newLayout(dir, pattern, payload)
+	if err != nil {
+		return nil, err
+	}
 	hr := hrdp{
+		rollFile: rollFile{
+			layout:   y,
+			compress: compress,
+			sync:     syncEvery,
+			closed:   closed,
+		},
 		payload: payload,
-		datadir: dir,
 	}
 
 	hr.WriteCloser, err = roll.Roll(hr.Open, options...)
@@ -103,24 +373,15 @@ func NewHRDP(dir string, payload uint8, options []roll.Option) (Writer, error) {
 	return &hr, nil
 }
 
-func (h *hrdp) Filename() string {
-	return h.filename
+func (h *hrdp) Close() error {
+	return h.close(h.WriteCloser)
 }
 
-func (h *hrdp) Open(n int, w time.Time) (io.WriteCloser, []io.Closer, error) {
-	datadir, err := mkdirAll(h.datadir, w)
+func (h *hrdp) Write(bs []byte) (int, error) {
+	hdr, err := erdle.DecodeHRDLHeader(bs)
 	if err != nil {
-		return nil, nil, err
+		return 0, err
 	}
-	file := filepath.Join(datadir, fmt.Sprintf("rt_%06d_%s.dat", n, w.Format("150405")))
-	go removeEmpty(file, h.filename)
-
-	h.filename = file
-	wc, err := os.OpenFile(h.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	return wc, nil, err
-}
-
-func (h *hrdp) Write(bs []byte) (int, error) {
 	var (
 		f uint32
 		c uint8
@@ -130,37 +391,26 @@ func (h *hrdp) Write(bs []byte) (int, error) {
 	binary.Write(&buf, binary.LittleEndian, uint32(len(bs)+14))
 	binary.Write(&buf, binary.BigEndian, uint16(0))
 	binary.Write(&buf, binary.BigEndian, h.payload)
-	binary.Write(&buf, binary.BigEndian, bs[8])
+	binary.Write(&buf, binary.BigEndian, hdr.Channel)
 	// set acquisition timestamp
-	coarse := binary.LittleEndian.Uint32(bs[16:])
-	fine := binary.LittleEndian.Uint16(bs[20:])
-	acq := timutil.Join6(coarse, fine)
-	f, c = timutil.Split5(timutil.GPSTime(acq, true))
+	f, c = timutil.Split5(timutil.GPSTime(hdr.When, true))
 
 	binary.Write(&buf, binary.BigEndian, f)
 	binary.Write(&buf, binary.BigEndian, c)
 	//set reception timestamp
-	f, c = timutil.Split5(timutil.GPSTime(time.Now(), true))
+	f, c = timutil.Split5(timutil.GPSTime(h.now(), true))
 	binary.Write(&buf, binary.BigEndian, f)
 	binary.Write(&buf, binary.BigEndian, c)
 
 	buf.Write(bs)
 
-	if _, err := h.WriteCloser.Write(buf.Bytes()); err != nil {
+	e := manifestEntry{channel: hdr.Channel, when: hdr.When, size: len(bs)}
+	if err := h.write(h.WriteCloser, buf.Bytes(), e); err != nil {
 		return 0, err
 	}
 	return len(bs), nil
 }
 
-func mkdirAll(datadir string, w time.Time) (string, error) {
-	y := fmt.Sprintf("%04d", w.Year())
-	d := fmt.Sprintf("%03d", w.YearDay())
-	r := fmt.Sprintf("%02d", w.Hour())
-
-	datadir = filepath.Join(datadir, y, d, r)
-	return datadir, os.MkdirAll(datadir, 0755)
-}
-
 func removeEmpty(file, old string) {
 	if old == "" || old == file {
 		return
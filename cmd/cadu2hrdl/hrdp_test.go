@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+	"github.com/busoc/timutil"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func TestHRDPWriteTimestamps(t *testing.T) {
+	var (
+		when = time.Date(2019, 8, 1, 7, 0, 0, 0, time.UTC)
+		recv = when.Add(90 * time.Second)
+		buf  bufferCloser
+	)
+	h := hrdp{
+		rollFile:    rollFile{Clock: func() time.Time { return recv }},
+		payload:     3,
+		WriteCloser: &buf,
+	}
+	n, pk := erdle.Unstuff(erdletest.BuildHRDL(erdle.HRDLHeader{Channel: 2, When: when}, nil))
+	pk = pk[:n]
+	hdr, err := erdle.DecodeHRDLHeader(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Write(pk); err != nil {
+		t.Fatal(err)
+	}
+	bs := buf.Bytes()
+	if z := binary.LittleEndian.Uint32(bs); int(z) != len(pk)+14 || len(bs) != len(pk)+18 {
+		t.Fatalf("unexpected record length: %d (%d bytes written)", z, len(bs))
+	}
+	if bs[6] != 3 || bs[7] != 2 {
+		t.Errorf("unexpected payload/channel: %d/%d", bs[6], bs[7])
+	}
+	checkStamp := func(name string, bs []byte, w time.Time) {
+		t.Helper()
+		f, c := timutil.Split5(timutil.GPSTime(w, true))
+		if got := binary.BigEndian.Uint32(bs); got != f || bs[4] != c {
+			t.Errorf("%s: want %d.%d, got %d.%d", name, f, c, got, bs[4])
+		}
+	}
+	checkStamp("acquisition", bs[8:], hdr.When)
+	checkStamp("reception", bs[13:], recv)
+	if !bytes.Equal(bs[18:], pk) {
+		t.Errorf("packet not written after its header")
+	}
+}
+
+func TestHRDPReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hrdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recv := time.Date(2019, 8, 1, 7, 1, 30, 0, time.UTC)
+	var (
+		files []string
+		pks   [][]byte
+	)
+	for i := 0; i < 2; i++ {
+		var buf bufferCloser
+		h := hrdp{
+			rollFile:    rollFile{Clock: func() time.Time { return recv }},
+			payload:     3,
+			WriteCloser: &buf,
+		}
+		for j := 0; j < 2; j++ {
+			n, pk := erdle.Unstuff(buildPacket(2, uint32(i*2+j), 100))
+			if _, err := h.Write(pk[:n]); err != nil {
+				t.Fatal(err)
+			}
+			pks = append(pks, pk[:n])
+		}
+		file := filepath.Join(dir, fmt.Sprintf("rt_%d.dat", i))
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	r := hrdpReader{files: files, stamp: true}
+	defer r.Close()
+	body := make([]byte, 4096)
+	for i, pk := range pks {
+		n, err := r.Read(body)
+		if err != nil {
+			t.Fatalf("packet %d: unexpected error: %v", i+1, err)
+		}
+		if !bytes.Equal(body[:n], pk) {
+			t.Fatalf("packet %d: not read back from its record", i+1)
+		}
+		want := timutil.Join5(timutil.Split5(timutil.GPSTime(recv, true)))
+		if got, ok := reception(&r); !ok || !got.Equal(want) {
+			t.Fatalf("packet %d: want reception %s, got %s", i+1, want, got)
+		}
+	}
+	if _, err := r.Read(body); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
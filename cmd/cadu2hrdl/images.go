@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/vmu"
+)
+
+// imageInfo is the metadata written next to the payload of each image.
+type imageInfo struct {
+	Channel  uint8     `json:"channel"`
+	Origin   uint8     `json:"origin"`
+	Sequence uint32    `json:"sequence"`
+	Counter  uint32    `json:"counter"`
+	When     time.Time `json:"when"`
+	Acqtime  time.Time `json:"acqtime"`
+	UPI      string    `json:"upi"`
+	Size     int       `json:"size"`
+	// Header is the part of the image header before the UPI (hex encoded).
+	Header string `json:"header"`
+}
+
+// extractImages writes the payload of each image packet read from r (the
+// image header excluded) in dir as <upi>_<seq>.raw, with its metadata in
+// <upi>_<seq>.json. Packets of other types are skipped.
+func extractImages(r io.Reader, dir string, keep bool, st strict) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	body := make([]byte, vmu.BufferSize)
+	var total, skipped, errCRC, errMissing, errInvalid, errLength int
+	for {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if st.Fail(err) {
+				return err
+			}
+			if n, ok := erdle.IsMissingCadu(err); ok {
+				errMissing += n
+			} else if erdle.IsCRCError(err) {
+				errCRC++
+			} else if erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				errLength++
+			} else {
+				return err
+			}
+			continue
+		}
+		z := 0
+		if n >= 12 {
+			z = int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12
+		}
+		if z < minPacketLen || z > n {
+			if err := (erdle.LengthError{Want: z, Got: n}); st.Fail(err) {
+				return err
+			}
+			errLength++
+			continue
+		}
+		if s := vmu.Sum(body[8 : z-4]); s != binary.LittleEndian.Uint32(body[z-4:]) {
+			if err := checksumError(r, binary.LittleEndian.Uint32(body[z-4:]), s); st.Fail(err) {
+				return err
+			}
+			errInvalid++
+			if !keep {
+				continue
+			}
+		}
+		h, err := erdle.DecodeHRDLHeader(body[:z])
+		if err != nil {
+			errLength++
+			continue
+		}
+		payload, ok := erdle.ImagePayload(body[:z])
+		if !ok {
+			skipped++
+			continue
+		}
+		if err := writeImage(dir, h, body[:z], payload); err != nil {
+			return err
+		}
+		total++
+	}
+	log.Printf("%d images written, %d other packets, %d invalid cks, %d invalid len (%d missing cadus, %d corrupted)", total, skipped, errInvalid, errLength, errMissing, errCRC)
+	return nil
+}
+
+func writeImage(dir string, h erdle.HRDLHeader, bs, payload []byte) error {
+	upi := h.UPI
+	if upi == "" {
+		upi = "image"
+	}
+	file := filepath.Join(dir, fmt.Sprintf("%s_%08d", strings.Map(safeRune, upi), h.Sequence))
+	if err := ioutil.WriteFile(file+".raw", payload, 0644); err != nil {
+		return err
+	}
+	// the image header is between the data header and the payload
+	offset := erdle.WordLen + erdle.HRDLSizeLen + erdle.VMUHeaderLen + erdle.DataHeaderLen
+	info := imageInfo{
+		Channel:  h.Channel,
+		Origin:   h.Origin,
+		Sequence: h.Sequence,
+		Counter:  h.Counter,
+		When:     h.When,
+		Acqtime:  h.Acqtime,
+		UPI:      h.UPI,
+		Size:     len(payload),
+		Header:   hex.EncodeToString(bs[offset : offset+erdle.ImageHeaderLen-erdle.UPILen]),
+	}
+	buf, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+".json", buf, 0644)
+}
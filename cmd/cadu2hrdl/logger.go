@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Logger reports the statistics collected by the commands. row is the format
+// used to present the values of the fields in human readable form.
+type Logger interface {
+	Log(row string, fs ...Field)
+}
+
+func NewLogger(prefix string, format string) Logger {
+	switch strings.ToLower(format) {
+	case "json":
+		return JSONLogger(os.Stderr, prefix)
+	case "none", "discard":
+		return discardLogger{}
+	default:
+		return TextLogger(os.Stderr, prefix)
+	}
+}
+
+type textLogger struct {
+	*log.Logger
+}
+
+func TextLogger(w io.Writer, prefix string) Logger {
+	return textLogger{Logger: log.New(w, "["+prefix+"] ", 0)}
+}
+
+func (t textLogger) Log(row string, fs ...Field) {
+	vs := make([]interface{}, len(fs))
+	for i, f := range fs {
+		vs[i] = f.Value
+	}
+	t.Printf(row, vs...)
+}
+
+type jsonLogger struct {
+	mu      sync.Mutex
+	prefix  string
+	encoder *json.Encoder
+}
+
+func JSONLogger(w io.Writer, prefix string) Logger {
+	return &jsonLogger{prefix: prefix, encoder: json.NewEncoder(w)}
+}
+
+func (j *jsonLogger) Log(_ string, fs ...Field) {
+	vs := make(map[string]interface{}, len(fs)+2)
+	for _, f := range fs {
+		vs[f.Name] = f.Value
+	}
+	vs["ts"] = time.Now().UTC()
+	vs["source"] = j.prefix
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.encoder.Encode(vs)
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Log(string, ...Field) {}
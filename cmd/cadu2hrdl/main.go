@@ -4,31 +4,41 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/busoc/erdle"
 	"github.com/busoc/erdle/cmd/internal/multireader"
+	"github.com/busoc/timutil"
 	"github.com/midbel/cli"
-	"github.com/midbel/ringbuffer"
 	"github.com/midbel/roll"
 	"github.com/midbel/toml"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
-	ErrSkip    = errors.New("skip")
 	ErrInvalid = errors.New("hrdl: invalid checksum")
 	ErrLength  = errors.New("hrdl: invalid length")
+	// ErrUndelimited is given by nextPacket with a packet that has not been
+	// delimited by the next synchronization word but that is long enough (as
+	// declared by its size) to be considered as complete.
+	ErrUndelimited = errors.New("hrdl: packet not delimited")
+	// ErrTrailerMissing is given by nextPacket with a packet that has not been
+	// delimited by the next synchronization word and that is only missing its
+	// checksum. The readers give it with the packet completed with a null
+	// checksum.
+	ErrTrailerMissing = errors.New("hrdl: packet without checksum")
 )
 
 const (
@@ -52,7 +62,7 @@ func protoFromAddr(a string) (string, string) {
 
 var commands = []*cli.Command{
 	{
-		Usage: "list [-c skip] [-k keep] <file...>",
+		Usage: "list [-c skip] [-k keep] [-D dir] [-strict] [-missing] [-progress] [-M size] [-R] [-latency] [-rt] [-n count] [-valid] [-debug] <file...>",
 		Short: "list HRDL packets contained in the given file(s)",
 		Run:   runList,
 		Desc: `
@@ -60,22 +70,66 @@ options:
 
   -c COUNT   skip COUNT bytes between each packets
   -k         keep invalid HRDL packets
+  -D DIR     write the payload of each packet under DIR instead of listing them
+  -strict    abort on the first corrupted packet
+  -missing   abort also on missing cadus (only with -strict)
+  -progress  report progress of the scan on stderr every second
+  -M SIZE    reject HRDL packets larger than SIZE bytes
+  -R         print the reception time of the packets (HRDFE files, implies -c 8)
+  -latency   print the delay between the acquisition and the reception time of
+             the packets and its min/avg/max at the end (implies -R)
+  -rt        read the HRDP files written by store instead of cadus
+  -n COUNT   stop after COUNT packets (not with -D)
+  -valid     count only the valid packets for -n
+  -debug     dump the first bytes of the HRDL packets whose length does not
+             match their size and the offset where their size has been read
+
+With -R, the reception time of a packet is the reception time of the cadu that
+completed it or, with -rt, the reception time written by store in its record.
+With -latency, the delay is computed from the acquisition time of the packet
+(Acqtime); "-" is printed for the packets without one.
+
+With -rt, the packets are read from the records of the HRDP files (compressed
+or not): -c, -M, -progress and -debug do not apply.
+
+With -D, payloads are written to DIR/chan_NN/seq_NNNNNNNN.bin. The files of
+image packets are prefixed by the UPI of the image instead of seq.
 `,
 	},
 	{
-		Usage: "count [-t type] [-b by] [-c skip] <file...>",
+		Usage: "count [-t type] [-b by] [-c skip] [-x] [-f filter] [-strict] [-missing] [-progress] [-reorder n] [-M size] [-H] [-p n] [-debug] [-nofill] <file...>",
 		Short: "count cadus/HRDL packets contained in the given files",
 		Run:   runCount,
 		Desc: `
 options:
 
-  -b BY      report count by origin or by channel if type is hrdl
+  -b BY      report count by origin, by channel or by upi if type is hrdl
   -c COUNT   skip COUNT bytes between each packets
   -t TYPE    specify the packet type (hrdl or cadu)
+  -x         read cadus from pcap file(s)
+  -f FILTER  BPF filter to select packets from pcap file(s)
+  -strict    abort on the first corrupted packet
+  -missing   abort also on missing (or out of order) cadus (only with -strict)
+  -progress  report progress of the scan on stderr every second
+  -reorder N cadus behind the previous one by at most N are counted as out of
+             order instead of missing (only if type is cadu)
+  -M SIZE    reject HRDL packets larger than SIZE bytes
+  -H         decode only the headers of HRDL packets (faster but checksums of
+             packets are not verified)
+  -p N       decode N files in parallel and merge their counts in the order of
+             the files (only if type is hrdl). Each file should be decodable on
+             its own: a packet split over two files is lost. Files are decoded
+             serially with -x, -strict or when a file does not only contain
+             whole cadus
+  -debug     dump the first bytes of the HRDL packets whose length does not
+             match their size and the offset where their size has been read
+             (the offset is counted from the beginning of each file with -p)
+  -nofill    exclude the fill frames from the number of cadus (only if type is
+             cadu). They are still reported and used to detect missing cadus
 `,
 	},
 	{
-		Usage: "replay [-c skip] [-r rate] <host:port> <file...>",
+		Usage: "replay [-c skip] [-r rate] [-x] [-f filter] [-speed speed] [-exact] [-index file] [-channel n] [-from time] [-to time] [-drop p] [-corrupt p] [-tls] <host:port> <file...>",
 		Short: "send cadus from a file to a remote host",
 		Run:   runReplay,
 		Desc: `
@@ -83,28 +137,92 @@ options:
 
   -c    COUNT   skip COUNT bytes between each packets
   -r    RATE    define the output bandwidth usage in bytes
+  -x            read cadus from pcap files
+  -f    FILTER  BPF filter to select packets from the pcap files
+  -speed SPEED  replay SPEED times faster than the recorded timing
+  -exact        send cadus as read, without checking their CRC nor their counter
+  -index FILE   replay only the packets selected in FILE (output of index)
+  -channel N    select the packets of channel N in the index
+  -from  TIME   select the packets of the index from TIME
+  -to    TIME   select the packets of the index until TIME
+  -drop  P      probability to drop a cadu (creating a gap in the counter)
+  -corrupt P    probability to flip a byte of the body of a cadu (breaking its
+                CRC)
+  -tls          secure the connection to a tcp host with TLS
+  -ca   FILE    certificate authority used to verify the remote host
+  -cert FILE    client certificate
+  -key  FILE    key of the client certificate
+  -insecure     do not verify the certificate of the remote host
+
+With -x and a RATE of 0, cadus are sent with the timing of their capture,
+optionally accelerated with -speed. -speed is ignored when RATE is set.
+
+Without -exact, replay stops at the first invalid or missing cadu. With -exact,
+the bytes of the files are sent unchanged (except the COUNT bytes skipped) and
+no cadu is checked. -exact can be combined with a RATE and with -speed.
+
+With -index, only the cadus of the selected packets are read from the file
+(that should be the one used to create the index with the same COUNT) and they
+are sent as with -exact. The channel of the index is the origin of the packets
+when it has been created with -b mix. Times are given as RFC3339 or as in the
+index (UTC).
+
+-drop and -corrupt are applied to the cadus after they have been read (and
+checked without -exact) to test the consumers of the stream with the errors of
+real data. The number of cadus dropped and corrupted is given at the end.
 `,
 	},
 	{
-		Usage: "store [-k keep] [-q queue] <host:port> <datadir>",
+		Usage: "generate [-r rate] [-vc channel] [-n count] [-s size] [-gaps p] [-crc p] <udp://host:port|file>",
+		Short: "generate a stream of synthetic cadus",
+		Run:   runGenerate,
+		Desc: `
+options:
+
+  -r    RATE     define the output bandwidth usage in bytes
+  -vc   CHANNEL  virtual channel of the cadus
+  -n    COUNT    number of cadus to generate (0 to never stop)
+  -s    SIZE     size of the payload of the HRDL packets
+  -gaps P        probability to drop a cadu (creating a gap in the counter)
+  -crc  P        probability to corrupt the CRC of a cadu
+`,
+	},
+	{
+		Usage: "store [-k keep] [-q queue] [-n] <host:port> <datadir>",
 		Short: "create an archive of HRDL packets from a cadus stream",
 		Run:   runStore,
 		Desc: `
 options:
 
   -c          use given configuration file to load options
+  -l LAYOUT   template used to build the path of the files
+  -g          compress files with gzip (.gz is added to the filenames)
   -i INTERVAL time between automatic file rotation
   -t TIMEOUT  timeout before forcing file rotation
   -s SIZE     max size (in bytes) of a file before triggering a rotation
   -c COUNT    max number of packets in a file before triggering a rotation
+  -sync N     sync the files on disk every N packets (a crash loses at most the
+              last N packets but each sync slows down the writes)
   -b BUFFER   size of buffer between incoming cadus and reassembler
+  -B SIZE     size of the read buffer of the socket
   -p PAYLOAD  identifier of source payload
   -q SIZE     size of the queue to store reassemble packets
   -k          store HRDL packets even if they are corrupted
+  -w WAIT     time to wait for room in a full queue before dropping packets
+  -S          discard HRDL packets with invalid stuff bytes
+  -drop WHICH packet dropped when a queue is full: newest (default) or oldest
+  -M SIZE     reject HRDL packets larger than SIZE bytes (resync on the next one)
+  -x          read cadus from a pcap file instead of an UDP address
+  -f FILTER   BPF filter to select packets from the pcap file
+  -L FORMAT   format of the statistics (text, json, none)
+  -n          dry run: reassemble and validate packets without writing them
+  -state FILE save the last file, packet time and sequence counters in FILE
+  -resume     skip the packets older than the last one saved in the state file
+              (only when reading HRDL packets from a pcap file)
 `,
 	},
 	{
-		Usage: "relay [-b buffer] [-c] [-r rate] [-q queue] [-i instance] [-c conn] [-k keep] <host:port> <host:port>",
+		Usage: "relay [-b buffer] [-c] [-r rate] [-q queue] [-i instance] [-c conn] [-k keep] [-t idle] [-ack] [-tls] <host:port> <host:port>",
 		Short: "reassemble incoming cadus to HRDL packets",
 		Run:   runRelay,
 		Desc: `
@@ -112,43 +230,128 @@ options:
 
   -c           use given configuration file to load options
   -b BUFFER    size of buffer between incoming cadus and reassembler
+  -B SIZE      size of the read buffer of the socket
   -q SIZE      size of the queue to store reassembled HRDL packets
-  -i INSTANCE  hadock instance
+  -i INSTANCE  hadock instance (0 or test, 1 or sim1, 2 or sim2, 255 or ops)
   -r RATE      outgoing bandwidth rate
   -c CONN      number of connections to open to remote host
   -k           don't relay invalid HRDL packets
+  -L FORMAT    format of the statistics (text, json, none)
+  -t IDLE      reopen connections unused for more than IDLE seconds
+  -S           discard HRDL packets with invalid stuff bytes
+  -drop WHICH  packet dropped when a queue is full: newest (default) or oldest
+  -M SIZE      reject HRDL packets larger than SIZE bytes (resync on the next one)
+  -ack         read the acks sent back by hadock and report rejected packets
+  -tls         secure the connections to the remote host with TLS
+  -ca FILE     certificate authority used to verify the remote host
+  -cert FILE   client certificate
+  -key FILE    key of the client certificate
+  -insecure    do not verify the certificate of the remote host
+
+The remote address can be a comma separated list of addresses. Packets are sent
+to the first one and mirrored to the others (dropped if they can not keep up).
+
+With a nats:// remote address (eg nats://host:4222/erdle?by=origin), packets
+are published to a NATS server on the subject erdle.<channel> (or erdle.<origin>
+with by=origin). -i, -r, -c, -t, -ack and -tls do not apply to NATS. NATS is
+the only message broker supported: kafka:// addresses are rejected.
 `,
 	},
 	{
-		Usage: "dump [-q queue] [-i instance] [-k keep] <host:port>",
+		Usage: "dump [-q queue] [-i instance] [-k keep] [-v] [-C] [-latency] [-proto] [-n count] [-valid] <host:port>",
 		Short: "print the raw bytes on incoming HRDL packets",
 		Run:   runDump,
 		Desc: `
 options:
 
   -q SIZE      size of the queue to store reassembled HRDL packets
-  -i INSTANCE  hadock instance
+  -i INSTANCE  hadock instance (0 or test, 1 or sim1, 2 or sim2, 255 or ops)
+  -k           keep invalid HRDL packets
+  -L FORMAT    format of the statistics (text, json, none)
+  -v           print the counters of the first and last cadus of each packet
+  -S           discard HRDL packets with invalid stuff bytes
+  -B SIZE      size of the read buffer of the socket
+  -C           correlate the gaps in the sequence counters with missing cadus
+  -latency     print the delay between the acquisition time of the packets and
+               the time they are reassembled, and its min/avg/max at the end
+               (not with -proto)
+  -proto       write the HRDL packets on stdout as protobuf messages
+  -n COUNT     stop after COUNT packets (not with -proto)
+  -valid       count only the valid packets for -n
+
+With -proto, each packet is written as an Erdle message (see erdle.proto)
+preceded by its length (varint).
+
+With -C, three columns are added: the delta of the sequence counter and the
+number of cadus missing since the previous packet of the same channel and a
+flag: hrdl (sequence gap without missing cadus, a reassembly issue), cadu
+(missing cadus without sequence gap), loss (both) or - (none).
+`,
+	},
+	{
+		Usage: "serve [-q queue] [-k keep] [-S] [-http addr] <host:port>",
+		Short: "serve reassembled HRDL packets over HTTP",
+		Run:   runServe,
+		Desc: `
+options:
+
+  -q SIZE      size of the queue to store reassembled HRDL packets
   -k           keep invalid HRDL packets
+  -S           discard HRDL packets with invalid stuff bytes
+  -L FORMAT    format of the statistics (text, json, none)
+  -http ADDR   address of the HTTP server
+  -B SIZE      size of the read buffer of the socket
+
+endpoints:
+
+  /stream      headers of the HRDL packets as they are reassembled (NDJSON)
+  /stats       counters of the reassembler and number of connected clients
+
+Each client of /stream has its own queue (of size -q). Packets are dropped for
+the clients that can not keep up.
 `,
 	},
 	{
-		Usage: "debug [-q queue] [-i instance] <host:port>",
+		Usage: "debug [-q queue] [-i instance] [-p count] [-n count] [-valid] [-tls] <host:port>",
 		Short: "print the raw bytes on incoming HRDL packets",
 		Run:   runDebug,
 		Desc: `
 options:
 
   -q SIZE      size of the queue to store reassembled HRDL packets
-  -i INSTANCE  hadock instance
+  -i INSTANCE  hadock instance (0 or test, 1 or sim1, 2 or sim2, 255 or ops)
+  -p COUNT     read at most COUNT connections at the same time
+  -n COUNT     stop after COUNT packets
+  -valid       count only the valid packets for -n
+  -tls         accept TLS connections (requires -cert and -key)
+  -ca FILE     certificate authority used to verify the clients certificates
+  -cert FILE   server certificate
+  -key FILE    key of the server certificate
+
+Each connection read uses a 8MB buffer. Connections above COUNT are accepted
+but are only read once another connection is closed.
 `,
 	},
 	{
-		Usage: "trace <host:port>",
+		Usage: "trace [-L format] [-j] [-jj] [-ws addr] [-g threshold] [-B size] <host:port>",
 		Short: "give statistics on incoming cadus stream",
 		Run:   runTrace,
+		Desc: `
+options:
+
+  -L FORMAT  format of the statistics (text, json, none)
+  -j         print statistics as NDJSON on stdout
+  -jj        print statistics and each cadu received as NDJSON on stdout
+  -ws ADDR   push gap alerts to the websocket clients connected to ADDR
+  -g GAP     minimum number of missing cadus to trigger an alert
+  -B SIZE    size of the read buffer of the socket
+
+The counters of the cadus are followed by virtual channel: the missing cadus
+are given by channel and their sum is the total.
+`,
 	},
 	{
-		Usage: "inspect [-c count] [-e every] [-p parallel] <file...>",
+		Usage: "inspect [-c count] [-e every] [-p parallel] [-hist] [-v] [-fill byte] <file...>",
 		Alias: []string{"dig"},
 		Short: "try to analyse how HRDL are organized into cadus",
 		Run:   runInspect,
@@ -158,22 +361,231 @@ options:
   -c COUNT     skip COUNT bytes between each packets
   -e EVERY     create reports by slice of EVERY packets
   -p PARALLEL  create reports in parallel workers
+  -hist        print the distribution of the sizes of HRDL packets
+  -v           print the report of each slice before the summary
+  -fill BYTE   byte of the body of fill frames (default: 0)
+
+Cadus of the idle virtual channel (63) are always fill frames.
+`,
+	},
+	{
+		Usage: "raw [-c skip] [-o file] [-l] [-H] [-T] [-M size] <file...>",
+		Short: "write reassembled HRDL packets back-to-back in a file",
+		Run:   runRaw,
+		Desc: `
+options:
+
+  -c COUNT  skip COUNT bytes between each packets
+  -o FILE   write HRDL packets to FILE (default: stdout)
+  -l        prefix each HRDL packet with its length (4 bytes, little endian)
+  -H        remove the sync word and the size from the HRDL packets
+  -T        remove the checksum from the HRDL packets
+  -M SIZE   reject HRDL packets larger than SIZE bytes
+
+Note that packets written without their trailer can not be verified anymore
+and that packets written without their header can only be split again if -l
+is also given.
 `,
 	},
 	{
-		Usage: "split [-d dir] <file...>",
+		Usage: "fix [-c skip] [-o file] [-renumber] <file...>",
+		Short: "rewrite the CRC (and the counters) of cadus",
+		Run:   runFix,
+		Desc: `
+options:
+
+  -c COUNT   skip COUNT bytes between each packets
+  -o FILE    write the cadus to FILE (default: stdout)
+  -renumber  rewrite the counters of the cadus to be sequential
+
+The cadus are written with the COUNT bytes that precede them. The counters are
+renumbered by virtual channel, starting at 0. Unlike cacat, fill frames are kept.
+`,
+	},
+	{
+		Usage: "diff [-c skip] [-v] <file> <file>",
+		Short: "compare the HRDL packets reassembled from two files",
+		Run:   runDiff,
+		Desc: `
+options:
+
+  -c COUNT  skip COUNT bytes between each packets
+  -v        print the packets that are missing or that differ
+
+Packets are matched by their channel and sequence counter. Matching packets
+differ when their content or their checksum is not the same.
+`,
+	},
+	{
+		Usage: "stats [-c skip] [-M size] [-json] <file...>",
+		Short: "print a summary of the cadus and HRDL packets of files",
+		Run:   runStats,
+		Desc: `
+options:
+
+  -c COUNT  skip COUNT bytes between each packets
+  -M SIZE   reject HRDL packets larger than SIZE bytes
+  -json     print the summary as json
+
+The files are read once. The summary gives the number of cadus (missing,
+corrupted and fill), the number of HRDL packets by channel (with a bad length
+or a bad checksum) and the time span of their acquisition time.
+`,
+	},
+	{
+		Usage: "checksum [-t type] [-c skip] <file...>",
+		Short: "compare checksums of cadus or HRDL packets with their computed value",
+		Run:   runChecksum,
+		Desc: `
+options:
+
+  -t TYPE   type of packets to check (hrdl, cadu)
+  -c COUNT  skip COUNT bytes between each packets
+
+checksum exits with an error if at least one checksum does not match.
+`,
+	},
+	{
+		Usage: "split [-f file] [-s] [-k] [-t] <file...>",
 		Short: "split packets from RT files into cadus",
 		Run:   runSplit,
+		Desc: `
+options:
+
+  -f FILE  write cadus to FILE
+  -s       write cadus in one file per virtual channel (cadus_vcNN.dat) in
+           the directory of FILE
+  -k       keep the records that already contain cadus as they are
+  -t       prepend the reception time of the records to each cadu
+
+By default, the content of each record is framed into new cadus (with new
+headers, counters and CRCs). With -k, records whose content starts with the
+cadu synchronization marker and whose length is a multiple of 1024 bytes are
+copied byte for byte instead. Other records are still framed into new cadus.
+Note that -s rewrites the counters and the CRCs of all cadus.
+
+With -t, each cadu is preceded by a 8 bytes header (as in HRDFE files): the
+reception time of its record in seconds since the unix epoch followed by 4
+zero bytes, both big endian. These files can be read back with -c 8.
+`,
+	},
+	{
+		Usage: "verify [-strict] <file...>",
+		Short: "verify the integrity of HRDL packets stored in HRDP files",
+		Run:   runVerify,
+		Desc: `
+options:
+
+  -strict  abort on the first corrupted packet
+`,
+	},
+	{
+		Usage: "tail [-k] [-i interval] <datadir>",
+		Short: "print the HRDL packets appended to the most recent HRDP file",
+		Run:   runTail,
+		Desc: `
+options:
+
+  -k           keep invalid HRDL packets
+  -i INTERVAL  time to wait before checking for new packets
+
+tail follows the files created by the store command: when a new file is
+created, tail finishes to read the current file and continues with the new one.
+`,
+	},
+	{
+		Usage: "unframe [-t type] [-o file] [-vc channel] <file...>",
+		Short: "write the HRDL packets of HRDP files as a raw HRDL or cadu stream",
+		Run:   runUnframe,
+		Desc: `
+options:
+
+  -t TYPE     type of the stream written (hrdl or cadu)
+  -o FILE     write the stream to FILE (default: stdout)
+  -vc CHANNEL virtual channel of the cadus (only if type is cadu)
+
+unframe is the inverse of store: the records added to each packet in the HRDP
+files are removed. With -t cadu, the packets are stuffed and framed in cadus
+numbered from 0.
+`,
 	},
 	{
-		Usage: "index [-c skip] [-b by] <file...>",
+		Usage: "watch [-i interval] <datadir>",
+		Short: "report statistics of the HRDL packets appended to HRDP files",
+		Run:   runWatch,
+		Desc: `
+options:
+
+  -i INTERVAL  time between two reports (default: 10s)
+
+watch follows the files created by the store command as tail does but, instead
+of printing the packets, it reports for each channel the number of packets per
+minute, the missing and the invalid packets written since the previous report
+(and since watch has been started).
+`,
+	},
+	{
+		Usage: "index [-c skip] [-b by] [-fill byte] <file...>",
 		Short: "create an index of hrdl packets by cadus",
 		Run:   runIndex,
 		Desc: `
 options:
 
+  -c COUNT    skip COUNT bytes between each packets
+  -b BY       report by origin or by channel
+  -fill BYTE  byte of the body of fill frames (default: 0)
+`,
+	},
+	{
+		Usage: "bench [-c skip] [-n runs] [-M size] <file...>",
+		Short: "measure the throughput of the reassembly of HRDL packets",
+		Run:   runBench,
+		Desc: `
+options:
+
+  -c COUNT  skip COUNT bytes between each packets
+  -n RUNS   number of times the files are read (default: 1)
+  -M SIZE   reject HRDL packets larger than SIZE bytes
+
+bench reads the files as fast as possible (no network, no rate limit),
+reassembles the HRDL packets, decodes their headers and verifies their checksum.
+It prints for each run the number of cadus, packets and megabytes processed per
+second and the allocations done. With several runs, the minimum, the median and
+the maximum of each rate are printed at the end. Except for the first run, the
+files are likely read from the page cache of the system.
+`,
+	},
+	{
+		Usage: "channels [-c skip] <file...>",
+		Short: "print the channels of the HRDL packets contained in the given files",
+		Run:   runChannels,
+		Desc: `
+options:
+
   -c COUNT  skip COUNT bytes between each packets
-  -b BY     report by origin or by channel
+
+Only the headers of the packets are decoded: it is faster than count but the
+packets are not verified.
+`,
+	},
+	{
+		Usage: "images [-c skip] [-k keep] [-strict] [-missing] [-M size] -D dir <file...>",
+		Short: "write the images carried by the HRDL packets of the given files",
+		Run:   runImages,
+		Desc: `
+options:
+
+  -c COUNT   skip COUNT bytes between each packets
+  -D DIR     directory where the images are written
+  -k         keep images of HRDL packets with an invalid checksum
+  -strict    abort on the first corrupted packet
+  -missing   abort also on missing cadus (only with -strict)
+  -M SIZE    reject HRDL packets larger than SIZE bytes
+
+The payload of each image packet (without its 52 bytes image header) is written
+to DIR/<upi>_<seq>.raw. The decoded headers of the packet are written next to it
+in DIR/<upi>_<seq>.json with the bytes of the image header that precede the UPI.
+Packets of other types are skipped.
 `,
 	},
 }
@@ -213,30 +625,272 @@ func main() {
 func runIndex(cmd *cli.Command, args []string) error {
 	count := cmd.Flag.Int("c", 0, "skip count bytes")
 	by := cmd.Flag.String("b", "", "")
+	fill := cmd.Flag.Uint("fill", 0, "byte of the body of fill frames")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	if *fill > 0xFF {
+		return fmt.Errorf("invalid fill pattern (%d)", *fill)
+	}
 	mr, err := multireader.New(cmd.Flag.Args())
 	if err != nil {
 		return err
 	}
-	return indexPackets(erdle.VCDUReader(mr, *count), strings.ToLower(*by))
+	return indexPackets(erdle.VCDUReader(mr, *count), strings.ToLower(*by), byte(*fill))
+}
+
+func runChannels(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	cs, err := erdle.Channels(erdle.VCDUReader(r, *count))
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		fmt.Printf("%02x\n", c)
+	}
+	return nil
+}
+
+func runImages(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	dir := cmd.Flag.String("D", "", "write images under directory")
+	keep := cmd.Flag.Bool("k", false, "keep invalid HRDL packets (bad sum only)")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+
+	var st strict
+	cmd.Flag.BoolVar(&st.Enabled, "strict", false, "abort on first corrupted packet")
+	cmd.Flag.BoolVar(&st.Missing, "missing", false, "abort on missing cadus in strict mode")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("no directory given")
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	hr := HRDLReader(r, *count)
+	hr.SetLimit(*limit)
+	return extractImages(hr, *dir, *keep, st)
+}
+
+func runVerify(cmd *cli.Command, args []string) error {
+	var st strict
+	cmd.Flag.BoolVar(&st.Enabled, "strict", false, "abort on first corrupted packet")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	return verifyHRDP(cmd.Flag.Args(), st)
+}
+
+func runTail(cmd *cli.Command, args []string) error {
+	keep := cmd.Flag.Bool("k", false, "keep invalid HRDL packets (bad sum only)")
+	every := cmd.Flag.Duration("i", time.Second, "polling interval")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	return tailHRDP(cmd.Flag.Arg(0), *every, *keep)
+}
+
+func runUnframe(cmd *cli.Command, args []string) error {
+	kind := cmd.Flag.String("t", "hrdl", "packet type")
+	file := cmd.Flag.String("o", "", "output file")
+	vc := cmd.Flag.Uint("vc", 0, "virtual channel")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, cadus, err := unframeHRDP(cmd.Flag.Args(), w, strings.ToLower(*kind), uint8(*vc))
+	if err == nil {
+		log.Printf("%d HRDL packets, %d cadus", count, cadus)
+	}
+	return err
+}
+
+func runBench(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	runs := cmd.Flag.Int("n", 1, "number of runs")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if cmd.Flag.NArg() == 0 {
+		return fmt.Errorf("no files given")
+	}
+	return benchFiles(cmd.Flag.Args(), *count, *limit, *runs)
+}
+
+func runWatch(cmd *cli.Command, args []string) error {
+	every := cmd.Flag.Duration("i", time.Second*10, "report interval")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	return watchHRDP(cmd.Flag.Arg(0), *every)
+}
+
+func runFix(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	file := cmd.Flag.String("o", "", "output file")
+	renumber := cmd.Flag.Bool("renumber", false, "renumber cadus")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	st, err := fixCadus(r, w, *count, *renumber)
+	if err == nil {
+		log.Printf("%d cadus, %d CRC corrected, %d renumbered", st.Count, st.CRC, st.Renumbered)
+	}
+	return err
+}
+
+func runRaw(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	file := cmd.Flag.String("o", "", "output file")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+	var opts rawOptions
+	cmd.Flag.BoolVar(&opts.Prefix, "l", false, "prefix packets with their length")
+	header := cmd.Flag.Bool("H", false, "strip header")
+	trailer := cmd.Flag.Bool("T", false, "strip trailer")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	opts.KeepHeader, opts.KeepTrailer = !*header, !*trailer
+	hr := HRDLReader(r, *count)
+	hr.SetLimit(*limit)
+	return rawHRDL(hr, w, opts)
+}
+
+func runDiff(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	verbose := cmd.Flag.Bool("v", false, "list packets")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if cmd.Flag.NArg() != 2 {
+		return fmt.Errorf("two files expected")
+	}
+	a, err := multireader.New([]string{cmd.Flag.Arg(0)})
+	if err != nil {
+		return err
+	}
+	b, err := multireader.New([]string{cmd.Flag.Arg(1)})
+	if err != nil {
+		return err
+	}
+	return diffHRDL(HRDLReader(a, *count), HRDLReader(b, *count), *verbose)
+}
+
+func runStats(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+	asJSON := cmd.Flag.Bool("json", false, "json output")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	s, err := summarize(r, *count, *limit)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(s)
+	}
+	fmt.Print(s)
+	return nil
+}
+
+func runChecksum(cmd *cli.Command, args []string) error {
+	kind := cmd.Flag.String("t", "", "packet type")
+	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	r, err := multireader.New(cmd.Flag.Args())
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(*kind) {
+	case "", "hrdl":
+		return checksumHRDL(HRDLReader(r, *count))
+	case "cadu":
+		return checksumCadus(r, *count)
+	default:
+		return fmt.Errorf("unknown packet type %s", *kind)
+	}
 }
 
 func runSplit(cmd *cli.Command, args []string) error {
 	file := cmd.Flag.String("f", filepath.Join(os.TempDir(), "cadus.dat"), "")
+	byVC := cmd.Flag.Bool("s", false, "split cadus by virtual channel")
+	keep := cmd.Flag.Bool("k", false, "keep cadus found in records")
+	stamp := cmd.Flag.Bool("t", false, "prepend reception time to cadus")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	w, err := os.Create(*file)
+	if *byVC && *stamp {
+		return fmt.Errorf("-s and -t can not be set together")
+	}
+	var (
+		w   io.WriteCloser
+		err error
+	)
+	if *byVC {
+		w = splitChannels(filepath.Dir(*file))
+	} else {
+		w, err = os.Create(*file)
+	}
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	body := make([]byte, erdle.CaduLen)
+	body := make([]byte, erdle.CaduLen+8)
 	for _, p := range cmd.Flag.Args() {
-		r, err := OpenRT(p)
+		r, err := OpenRT(p, *keep, *stamp)
 		if err != nil {
 			return err
 		}
@@ -249,88 +903,143 @@ func runSplit(cmd *cli.Command, args []string) error {
 	return nil
 }
 
+// channelWriter writes cadus in one file per virtual channel. The counters
+// of the cadus are rewritten so that each file has its own monotonic counter.
+type channelWriter struct {
+	dir     string
+	files   map[uint8]*os.File
+	counter map[uint8]uint32
+	buffer  []byte
+}
+
+func splitChannels(dir string) *channelWriter {
+	return &channelWriter{
+		dir:     dir,
+		files:   make(map[uint8]*os.File),
+		counter: make(map[uint8]uint32),
+	}
+}
+
+func (c *channelWriter) Write(bs []byte) (int, error) {
+	c.buffer = append(c.buffer, bs...)
+	for len(c.buffer) >= erdle.CaduLen {
+		if err := c.writeCadu(c.buffer[:erdle.CaduLen]); err != nil {
+			return 0, err
+		}
+		c.buffer = c.buffer[erdle.CaduLen:]
+	}
+	return len(bs), nil
+}
+
+func (c *channelWriter) writeCadu(bs []byte) error {
+	vc := bs[5] & 0x3F
+	f, ok := c.files[vc]
+	if !ok {
+		var err error
+		if f, err = os.Create(filepath.Join(c.dir, fmt.Sprintf("cadus_vc%02d.dat", vc))); err != nil {
+			return err
+		}
+		c.files[vc] = f
+	}
+	curr := c.counter[vc]
+	binary.BigEndian.PutUint32(bs[6:], curr<<8|uint32(bs[9]))
+	binary.BigEndian.PutUint16(bs[erdle.CaduTrailerIndex:], erdle.Sum(bs[erdle.MagicLen:erdle.CaduTrailerIndex]))
+	c.counter[vc] = (curr + 1) & erdle.CaduCounterMask
+
+	_, err := f.Write(bs)
+	return err
+}
+
+func (c *channelWriter) Close() error {
+	var err error
+	for _, f := range c.files {
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 type chunker struct {
 	io.Closer
 
 	counter uint32
-	digest  hash.Hash32
 	buffer  bytes.Buffer
-	scanner *bufio.Scanner
+	reader  *bufio.Reader
+
+	keep   bool
+	frames bytes.Buffer
+
+	stamp bool
+	recv  time.Time
 }
 
-func OpenRT(file string) (io.ReadCloser, error) {
+// OpenRT gives cadus from the records of a RT file. If keep is true, records
+// that already contain cadus are given as they are. If stamp is true, each cadu
+// is preceded by the reception time of its record in a 8 bytes header (as in
+// HRDFE files): the time in seconds since the unix epoch followed by 4 zero
+// bytes (both big endian).
+func OpenRT(file string, keep, stamp bool) (io.ReadCloser, error) {
 	r, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
-	s := bufio.NewScanner(r)
-	s.Buffer(make([]byte, 8<<20), 8<<20)
-	s.Split(scanPackets)
-
 	c := chunker{
-		Closer:  r,
-		scanner: s,
-		digest:  erdle.SumVCDU(),
+		Closer: r,
+		reader: bufio.NewReaderSize(r, 8<<20),
+		keep:   keep,
+		stamp:  stamp,
 	}
 	return &c, nil
 }
 
-func scanPackets(bs []byte, ateof bool) (int, []byte, error) {
-	if ateof {
-		return len(bs), bs, bufio.ErrFinalToken
-	}
-	if len(bs) < 4 {
-		return 0, nil, nil
-	}
-	size := int(binary.LittleEndian.Uint32(bs)) + 4
-	if len(bs) < size {
-		return 0, nil, nil
-	}
-	vs := make([]byte, size-18)
-	copy(vs, bs[18:])
-	return size, vs, nil
-}
-
 func (c *chunker) Read(bs []byte) (int, error) {
-	defer c.digest.Reset()
-
-	if c.buffer.Len() == 0 {
-		if !c.scanner.Scan() {
-			err := c.scanner.Err()
-			if err == nil {
-				err = io.EOF
-			}
+	if c.buffer.Len() == 0 && c.frames.Len() == 0 {
+		xs, err := readRecord(c.reader)
+		if err != nil {
 			return 0, err
 		}
-		c.buffer.Write(erdle.StuffBytes(c.scanner.Bytes()))
+		coarse := binary.BigEndian.Uint32(xs[9:])
+		c.recv = timutil.Join5(coarse, xs[13])
+
+		xs = xs[14:]
+		if c.keep && len(xs)%erdle.CaduLen == 0 && bytes.HasPrefix(xs, erdle.Magic) {
+			c.frames.Write(xs)
+		} else {
+			c.buffer.Write(erdle.StuffBytes(xs))
+		}
 	}
 	var b bytes.Buffer
-	b.Write(erdle.Magic)
-
-	w := io.MultiWriter(&b, c.digest)
-
-	binary.Write(w, binary.BigEndian, uint16(0x45c7))
-	binary.Write(w, binary.BigEndian, c.counter<<8)
-	binary.Write(w, binary.BigEndian, uint32(0xfdc33fff))
-	if n, _ := io.CopyN(w, &c.buffer, erdle.CaduBodyLen); n < erdle.CaduBodyLen {
-		w.Write(make([]byte, erdle.CaduBodyLen-n))
+	if c.stamp {
+		binary.Write(&b, binary.BigEndian, uint32(c.recv.Unix()))
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	}
+	if c.frames.Len() > 0 {
+		b.Write(c.frames.Next(erdle.CaduLen))
+		return io.ReadAtLeast(&b, bs, b.Len())
 	}
-	binary.Write(&b, binary.BigEndian, uint16(c.digest.Sum32()))
+	b.Write(erdle.EncodeCadu(c.counter, 7, c.buffer.Next(erdle.CaduBodyLen)))
 
 	c.counter++
 	if c.counter > erdle.CaduCounterMax {
 		c.counter = 0
 	}
-	return io.ReadAtLeast(&b, bs, erdle.CaduLen)
+	return io.ReadAtLeast(&b, bs, b.Len())
 }
 
 func runInspect(cmd *cli.Command, args []string) error {
 	count := cmd.Flag.Int("c", 0, "bytes to skip")
 	every := cmd.Flag.Int("e", 4096, "stats every x packets")
 	parallel := cmd.Flag.Int("p", 4, "parallel reader")
+	withHist := cmd.Flag.Bool("hist", false, "print histogram of HRDL packet sizes")
+	verbose := cmd.Flag.Bool("v", false, "print the report of each slice")
+	fill := cmd.Flag.Uint("fill", 0, "byte of the body of fill frames")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	if *fill > 0xFF {
+		return fmt.Errorf("invalid fill pattern (%d)", *fill)
+	}
 	if *every <= 0 {
 		*every = 4096
 	}
@@ -341,27 +1050,41 @@ func runInspect(cmd *cli.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	fill := erdle.CaduLen + *count
+	frame := erdle.CaduLen + *count
 
-	var grp errgroup.Group
-	sema := make(chan struct{}, *parallel)
+	var hist *histogram
+	if *withHist {
+		hist = new(histogram)
+	}
+	var (
+		grp   errgroup.Group
+		total inspection
+		sema  = make(chan struct{}, *parallel)
+	)
 	for {
 		sema <- struct{}{}
 
 		var b bytes.Buffer
-		if _, err := io.CopyN(&b, mr, int64(*every*fill)); err != nil {
+		if _, err := io.CopyN(&b, mr, int64(*every*frame)); err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
 		grp.Go(func() error {
-			err := inspectCadus(&b, *count)
+			err := inspectCadus(&b, *count, byte(*fill), hist, &total, *verbose)
 			<-sema
 			return err
 		})
 	}
-	return grp.Wait()
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+	log.Printf("total: %s", total.String())
+	if hist != nil {
+		log.Printf("histogram (total): %s", hist.String())
+	}
+	return nil
 }
 
 func runRelay(cmd *cli.Command, args []string) error {
@@ -370,21 +1093,38 @@ func runRelay(cmd *cli.Command, args []string) error {
 		//incoming cadus settings
 		Local  string `toml:"local"`
 		Buffer int    `toml:"buffer"`
+		Socket int    `toml:"socket"`
 		Queue  int    `toml:"queue"`
 		Keep   bool   `toml:"keep"`
+		Drop   string `toml:"droppolicy"`
+		Limit  int    `toml:"maxsize"`
 		//outgoging vmu settings
-		Remote   string `toml:"remote"`
-		Instance int    `toml:"instance"`
-		Rate     int    `toml:"rate"`
-		Num      int    `toml:"connections"`
+		Remote   string     `toml:"remote"`
+		Instance int        `toml:"instance"`
+		Rate     int        `toml:"rate"`
+		Num      int        `toml:"connections"`
+		Idle     int        `toml:"idle"`
+		Stuff    bool       `toml:"stuff"`
+		Ack      bool       `toml:"ack"`
+		TLS      tlsOptions `toml:"tls"`
+		Log      string     `toml:"log"`
 	}{}
 	cmd.Flag.IntVar(&settings.Queue, "q", 64, "queue size before dropping HRDL packets")
 	cmd.Flag.IntVar(&settings.Buffer, "b", 64<<20, "buffer size between socket and assembler")
+	cmd.Flag.IntVar(&settings.Socket, "B", DefaultReadBuffer, "socket read buffer size")
 	cmd.Flag.IntVar(&settings.Num, "n", 8, "number of connections to remote server")
-	cmd.Flag.IntVar(&settings.Instance, "i", -1, "hadock instance used")
+	settings.Instance = -1
+	cmd.Flag.Var((*instanceFlag)(&settings.Instance), "i", "hadock instance used")
 	cmd.Flag.IntVar(&settings.Rate, "r", 0, "bandwidth rate")
 	cmd.Flag.BoolVar(&settings.Keep, "k", false, "keep invalid HRDL packets (bad sum only)")
 	cmd.Flag.BoolVar(&settings.Config, "c", false, "use a configuration file")
+	cmd.Flag.StringVar(&settings.Log, "L", "", "format of statistics (text, json, none)")
+	cmd.Flag.IntVar(&settings.Idle, "t", 0, "seconds before idle connections are reopened")
+	cmd.Flag.BoolVar(&settings.Ack, "ack", false, "read acks sent by hadock")
+	cmd.Flag.BoolVar(&settings.Stuff, "S", false, "discard packets with invalid stuff bytes")
+	cmd.Flag.StringVar(&settings.Drop, "drop", "newest", "packet dropped when queue is full (newest, oldest)")
+	cmd.Flag.IntVar(&settings.Limit, "M", DefaultPacketLimit, "max size of HRDL packets")
+	settings.TLS.Bind(&cmd.Flag)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
@@ -401,43 +1141,115 @@ func runRelay(cmd *cli.Command, args []string) error {
 		settings.Local = cmd.Flag.Arg(0)
 		settings.Remote = cmd.Flag.Arg(1)
 	}
-	p, err := NewPool(settings.Remote, settings.Num, settings.Instance, settings.Rate)
+	cfg, err := settings.TLS.Config()
 	if err != nil {
 		return err
 	}
-	queue, err := reassemble(settings.Local, settings.Queue, settings.Buffer)
+	drop, err := parseDropPolicy(settings.Drop)
 	if err != nil {
 		return err
 	}
+	p, err := openSink(settings.Remote, settings.Num, settings.Instance, settings.Rate, settings.Queue, time.Duration(settings.Idle)*time.Second, settings.Ack, cfg)
+	if err != nil {
+		return err
+	}
+	c, err := listenUDP(settings.Local, settings.Socket)
+	if err != nil {
+		return err
+	}
+	queue, _ := reassemble(c, settings.Queue, settings.Buffer, settings.Limit, 0, drop, NewLogger("assemble", settings.Log))
 
 	var gp errgroup.Group
-	for bs := range validate(queue, settings.Queue, settings.Keep, true) {
-		xs := bs
+	for pk := range validate(queue, settings.Queue, settings.Keep, true, settings.Stuff, 0, drop, NewLogger("validate", settings.Log)) {
+		xs := pk.Data
 		gp.Go(func() error {
 			_, err := p.Write(xs)
 			return err
 		})
 	}
-	return gp.Wait()
+	err = gp.Wait()
+	if n := p.Nacks(); n > 0 {
+		log.Printf("%d packets rejected by %s", n, settings.Remote)
+	}
+	return err
 }
 
 func runReplay(cmd *cli.Command, args []string) error {
 	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
 	rate := cmd.Flag.Int("r", 8<<20, "output bandwith usage")
 	inspect := cmd.Flag.Bool("i", false, "inspect vcdu stream")
+	pcap := cmd.Flag.Bool("x", false, "read cadus from pcap files")
+	filter := cmd.Flag.String("f", "", "bpf filter")
+	speed := cmd.Flag.Float64("speed", 1, "replay speed relative to recorded timing")
+	exact := cmd.Flag.Bool("exact", false, "send cadus as read without checking them")
+	index := cmd.Flag.String("index", "", "index of the packets to replay")
+	channel := cmd.Flag.Int("channel", -1, "channel of the packets to replay (with -index)")
+	from := cmd.Flag.String("from", "", "time of the first packet to replay (with -index)")
+	to := cmd.Flag.String("to", "", "time of the last packet to replay (with -index)")
+	var faults replayFaults
+	cmd.Flag.Float64Var(&faults.Drop, "drop", 0, "probability to drop a cadu")
+	cmd.Flag.Float64Var(&faults.Corrupt, "corrupt", 0, "probability to corrupt a cadu")
+	var opts tlsOptions
+	opts.Bind(&cmd.Flag)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	cfg, err := opts.Config()
+	if err != nil {
+		return err
+	}
 
 	files := make([]string, cmd.Flag.NArg()-1)
 	for i := 1; i < cmd.Flag.NArg(); i++ {
 		files[i-1] = cmd.Flag.Arg(i)
 	}
-	r, err := multireader.New(files)
+	if *speed <= 0 {
+		return fmt.Errorf("invalid speed (%f)", *speed)
+	}
+	var r io.Reader
+	if *index != "" {
+		if *pcap || len(files) != 1 {
+			return fmt.Errorf("index requires one file of cadus")
+		}
+		sel := selection{Channel: *channel}
+		if sel.From, err = parseTime(*from); err != nil {
+			return err
+		}
+		if sel.To, err = parseTime(*to); err != nil {
+			return err
+		}
+		es, err := readIndex(*index)
+		if err != nil {
+			return err
+		}
+		rs := sel.Ranges(es)
+		if len(rs) == 0 {
+			return fmt.Errorf("no packets selected in %s", *index)
+		}
+		rc, err := selectCadus(files[0], *count, rs)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		// there are gaps between the selected ranges
+		r, *exact = rc, true
+	} else if *pcap {
+		var rc io.ReadCloser
+		if rc, err = PCAPReader(files, *filter); err == nil && *rate <= 0 {
+			rc, err = PacedReader(rc, *speed)
+		}
+		r = rc
+	} else {
+		r, err = multireader.New(files)
+	}
 	if err != nil {
 		return err
 	}
-	r = erdle.VCDUReader(r, *count)
+	if *exact {
+		r = rawFrames(r, *count)
+	} else {
+		r = erdle.VCDUReader(r, *count)
+	}
 	if *inspect {
 		pr, pw := io.Pipe()
 		defer pw.Close()
@@ -448,7 +1260,7 @@ func runReplay(cmd *cli.Command, args []string) error {
 				if _, err := io.CopyN(&b, pr, int64(*rate)); err != nil {
 					return
 				}
-				if err := inspectCadus(&b, 0); err != nil {
+				if err := inspectCadus(&b, 0, 0, nil, nil, true); err != nil {
 					return
 				}
 			}
@@ -457,9 +1269,44 @@ func runReplay(cmd *cli.Command, args []string) error {
 	}
 
 	n := time.Now()
-	z, err := replayCadus(cmd.Flag.Arg(0), r, *rate)
+	z, err := replayCadus(cmd.Flag.Arg(0), r, *rate, cfg, faults)
+	if err == nil {
+		elapsed := time.Since(n)
+		log.Printf("%d packets (%dMB, %s, avg: %.2fMbps, target: %.2fMbps), %d dropped, %d corrupted", z.Count, z.Size>>20, elapsed, mbps(z.Size, elapsed), mbps(*rate, time.Second), z.Missing, z.Invalid)
+	}
+	return err
+}
+
+func runGenerate(cmd *cli.Command, args []string) error {
+	var opts generateOptions
+	cmd.Flag.IntVar(&opts.Rate, "r", 8<<20, "output bandwith usage")
+	vc := cmd.Flag.Uint("vc", 0, "virtual channel")
+	cmd.Flag.IntVar(&opts.Count, "n", 0, "number of cadus")
+	cmd.Flag.IntVar(&opts.Size, "s", 4096, "size of HRDL payload")
+	cmd.Flag.Float64Var(&opts.Gaps, "gaps", 0, "probability of gaps")
+	cmd.Flag.Float64Var(&opts.Corrupt, "crc", 0, "probability of bad CRC")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if *vc > 0x3F {
+		return fmt.Errorf("invalid virtual channel (%d)", *vc)
+	}
+	if opts.Size < 0 {
+		return fmt.Errorf("invalid payload size (%d)", opts.Size)
+	}
+	opts.Channel = uint8(*vc)
+
+	w, err := openTarget(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	n := time.Now()
+	z, err := generateCadus(w, opts)
 	if err == nil {
-		log.Printf("%d packets (%dMB, %s)", z.Count, z.Size>>20, time.Since(n))
+		elapsed := time.Since(n)
+		log.Printf("%d cadus (%dKB, %s, avg: %.2fMbps), %d dropped, %d bad crc", z.Count, z.Size>>10, elapsed, mbps(z.Size, elapsed), z.Missing, z.Invalid)
 	}
 	return err
 }
@@ -468,19 +1315,95 @@ func runCount(cmd *cli.Command, args []string) error {
 	by := cmd.Flag.String("b", "", "by")
 	kind := cmd.Flag.String("t", "", "packet type")
 	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	pcap := cmd.Flag.Bool("x", false, "read cadus from pcap files")
+	filter := cmd.Flag.String("f", "", "bpf filter")
+	prog := cmd.Flag.Bool("progress", false, "report progress on stderr")
+	reorder := cmd.Flag.Uint("reorder", 0, "reorder window of cadus")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+	headers := cmd.Flag.Bool("H", false, "decode only headers of HRDL packets")
+	par := cmd.Flag.Int("p", 1, "number of files decoded in parallel")
+	debug := cmd.Flag.Bool("debug", false, "dump HRDL packets with an invalid length")
+	nofill := cmd.Flag.Bool("nofill", false, "exclude fill frames from the count of cadus")
+
+	var st strict
+	cmd.Flag.BoolVar(&st.Enabled, "strict", false, "abort on first corrupted packet")
+	cmd.Flag.BoolVar(&st.Missing, "missing", false, "abort on missing cadus in strict mode")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
 
-	r, err := multireader.New(cmd.Flag.Args())
+	var (
+		r   io.Reader
+		err error
+	)
+	var total int64
+	if *pcap {
+		r, err = PCAPReader(cmd.Flag.Args(), *filter)
+	} else {
+		r, err = multireader.New(cmd.Flag.Args())
+		if err == nil && *prog {
+			total, err = multireader.Size(cmd.Flag.Args())
+		}
+	}
 	if err != nil {
 		return err
 	}
+	var pr *progress
+	if *prog {
+		pr = &progress{Reader: r}
+		r = pr
+	}
 	switch strings.ToLower(*kind) {
 	case "", "hrdl":
-		return countHRDL(HRDLReader(r, *count), strings.ToLower(*by))
+		files := cmd.Flag.Args()
+		if *par > 1 && (*pcap || st.Enabled || len(files) < 2) {
+			*par = 1
+		}
+		if *par > 1 {
+			if err := checkAligned(files, *count); err != nil {
+				log.Printf("%s: files decoded serially", err)
+				*par = 1
+			}
+		}
+		var rs []io.Reader
+		if *par > 1 {
+			for _, f := range files {
+				fr, err := multireader.New([]string{f})
+				if err != nil {
+					return err
+				}
+				if pr != nil {
+					fr = pr.Wrap(fr)
+				}
+				rs = append(rs, fr)
+			}
+		} else {
+			rs = append(rs, r)
+		}
+		hs := make([]*hrdlReader, len(rs))
+		for j := range rs {
+			hs[j] = HRDLReader(rs[j], *count)
+			hs[j].SetLimit(*limit)
+			hs[j].SetDebug(*debug)
+			rs[j] = hs[j]
+		}
+		if pr != nil {
+			defer pr.Report(total, func() int {
+				var n int
+				for _, h := range hs {
+					n += h.Count()
+				}
+				return n
+			})()
+		}
+		return countHRDL(rs, strings.ToLower(*by), *headers, *par, st)
 	case "cadu":
-		return countCadus(erdle.VCDUReader(r, *count))
+		if pr != nil {
+			defer pr.Report(total, func() int {
+				return int(atomic.LoadInt64(&pr.read)) / (erdle.CaduLen + *count)
+			})()
+		}
+		return countCadus(erdle.VCDUReader(r, *count, erdle.WithReorderWindow(uint32(*reorder))), st, *nofill)
 	default:
 		return fmt.Errorf("unknown packet type %s", *kind)
 	}
@@ -489,43 +1412,125 @@ func runCount(cmd *cli.Command, args []string) error {
 func runList(cmd *cli.Command, args []string) error {
 	keep := cmd.Flag.Bool("k", false, "keep invalid HRDL packets (bad sum only)")
 	count := cmd.Flag.Int("c", 0, "bytes to skip before each packets")
+	dir := cmd.Flag.String("D", "", "write payloads under directory")
+	prog := cmd.Flag.Bool("progress", false, "report progress on stderr")
+	limit := cmd.Flag.Int("M", DefaultPacketLimit, "max size of HRDL packets")
+	recv := cmd.Flag.Bool("R", false, "print reception time (HRDFE or HRDP files)")
+	debug := cmd.Flag.Bool("debug", false, "dump HRDL packets with an invalid length")
+	delay := cmd.Flag.Bool("latency", false, "print delay between acquisition and reception (HRDFE or HRDP files)")
+	rt := cmd.Flag.Bool("rt", false, "read HRDP files written by store")
+
+	var sp sampling
+	cmd.Flag.IntVar(&sp.Limit, "n", 0, "stop after n packets")
+	cmd.Flag.BoolVar(&sp.Valid, "valid", false, "count only valid packets with -n")
+
+	var st strict
+	cmd.Flag.BoolVar(&st.Enabled, "strict", false, "abort on first corrupted packet")
+	cmd.Flag.BoolVar(&st.Missing, "missing", false, "abort on missing cadus in strict mode")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	var lat *latency
+	if *delay {
+		lat = new(latency)
+	}
+	if *rt {
+		hr := hrdpReader{
+			files: cmd.Flag.Args(),
+			stamp: *recv || *delay,
+		}
+		defer hr.Close()
+		if *dir != "" {
+			return demuxHRDL(&hr, *dir, *keep, st)
+		}
+		return listHRDL(&hr, *keep, st, sp, lat)
+	}
 	r, err := multireader.New(cmd.Flag.Args())
 	if err != nil {
 		return err
 	}
-	return listHRDL(HRDLReader(r, *count), *keep)
+	var pr *progress
+	if *prog {
+		pr = &progress{Reader: r}
+		r = pr
+	}
+	var hr *hrdlReader
+	if *recv || *delay {
+		hr = HRDFEReader(r)
+	} else {
+		hr = HRDLReader(r, *count)
+	}
+	hr.SetLimit(*limit)
+	hr.SetDebug(*debug)
+	if pr != nil {
+		total, err := multireader.Size(cmd.Flag.Args())
+		if err != nil {
+			return err
+		}
+		defer pr.Report(total, hr.Count)()
+	}
+	if *dir != "" {
+		return demuxHRDL(hr, *dir, *keep, st)
+	}
+	return listHRDL(hr, *keep, st, sp, lat)
 }
 
 func runStore(cmd *cli.Command, args []string) error {
 	settings := struct {
 		Config  bool   `toml:"-"`
+		DryRun  bool   `toml:"-"`
 		Address string `toml:"address"`
 		Dir     string `toml:"datadir"`
+		Pcap    bool   `toml:"pcap"`
+		Filter  string `toml:"filter"`
+		Socket  int    `toml:"socket"`
+		State   string `toml:"state"`
+		Resume  bool   `toml:"resume"`
+		Log     string `toml:"log"`
 		Roll    struct {
+			Layout   string        `toml:"layout"`
+			Compress bool          `toml:"compress"`
 			Interval time.Duration `toml:"interval"`
 			Timeout  time.Duration `toml:"timeout"`
 			MaxSize  int           `toml:"maxsize"`
 			MaxCount int           `toml:"maxcount"`
+			Sync     int           `toml:"sync"`
 		} `toml:"storage"`
 		Data struct {
-			Payload uint `toml:"payload"`
-			Buffer  int  `toml:"buffer"`
-			Queue   int  `toml:"queue"`
-			Keep    bool `toml:"keep"`
+			Payload uint          `toml:"payload"`
+			Buffer  int           `toml:"buffer"`
+			Queue   int           `toml:"queue"`
+			Keep    bool          `toml:"keep"`
+			Wait    time.Duration `toml:"wait"`
+			Stuff   bool          `toml:"stuff"`
+			Drop    string        `toml:"droppolicy"`
+			Limit   int           `toml:"maxsize"`
 		} `toml:"hrdl"`
+		Upload uploadOptions `toml:"upload"`
 	}{}
+	cmd.Flag.StringVar(&settings.Roll.Layout, "l", "", "template used to build filenames")
+	cmd.Flag.BoolVar(&settings.Roll.Compress, "g", false, "compress files with gzip")
 	cmd.Flag.DurationVar(&settings.Roll.Interval, "i", time.Minute*5, "rotation interval")
 	cmd.Flag.DurationVar(&settings.Roll.Timeout, "t", time.Minute, "rotation timeout")
 	cmd.Flag.UintVar(&settings.Data.Payload, "p", 0, "payload identifier")
 	cmd.Flag.IntVar(&settings.Roll.MaxSize, "s", 0, "size threshold before rotation")
 	cmd.Flag.IntVar(&settings.Roll.MaxCount, "z", 0, "packet threshold before rotation")
+	cmd.Flag.IntVar(&settings.Roll.Sync, "sync", 0, "sync files on disk every n packets")
 	cmd.Flag.IntVar(&settings.Data.Queue, "q", 64, "queue size before dropping HRDL packets")
 	cmd.Flag.IntVar(&settings.Data.Buffer, "b", 64<<20, "buffer size")
+	cmd.Flag.IntVar(&settings.Socket, "B", DefaultReadBuffer, "socket read buffer size")
 	cmd.Flag.BoolVar(&settings.Data.Keep, "k", false, "keep invalid HRDL packets (bad sum only)")
+	cmd.Flag.DurationVar(&settings.Data.Wait, "w", 0, "wait before dropping packets when queue is full")
+	cmd.Flag.BoolVar(&settings.Data.Stuff, "S", false, "discard packets with invalid stuff bytes")
+	cmd.Flag.StringVar(&settings.Data.Drop, "drop", "newest", "packet dropped when queue is full (newest, oldest)")
+	cmd.Flag.IntVar(&settings.Data.Limit, "M", DefaultPacketLimit, "max size of HRDL packets")
 	cmd.Flag.BoolVar(&settings.Config, "c", false, "use a configuration file")
+	cmd.Flag.BoolVar(&settings.Pcap, "x", false, "read cadus from a pcap file")
+	cmd.Flag.StringVar(&settings.Filter, "f", "", "bpf filter")
+	cmd.Flag.StringVar(&settings.Log, "L", "", "format of statistics (text, json, none)")
+	cmd.Flag.BoolVar(&settings.DryRun, "n", false, "dry run: do not write packets to disk")
+	cmd.Flag.StringVar(&settings.State, "state", "", "file where the progress of store is saved")
+	cmd.Flag.BoolVar(&settings.Resume, "resume", false, "skip packets older than the saved state (pcap only)")
 
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
@@ -541,131 +1546,295 @@ func runStore(cmd *cli.Command, args []string) error {
 		}
 		settings.Roll.Interval = settings.Roll.Interval * time.Second
 		settings.Roll.Timeout = settings.Roll.Timeout * time.Second
+		settings.Data.Wait = settings.Data.Wait * time.Millisecond
 	} else {
 		settings.Address = cmd.Flag.Arg(0)
 		settings.Dir = cmd.Flag.Arg(1)
 	}
+	drop, err := parseDropPolicy(settings.Data.Drop)
+	if err != nil {
+		return err
+	}
+	if settings.Resume && (settings.State == "" || settings.Data.Payload == 0) {
+		return fmt.Errorf("resume requires a state file and HRDL packets")
+	}
+	var st *state
+	if settings.State != "" {
+		s, err := loadState(settings.State)
+		if err != nil {
+			return err
+		}
+		if !s.Last.IsZero() {
+			log.Printf("previous run: last packet at %s written in %s (%d channels)", s.Last.Format(time.RFC3339), s.Filename, len(s.Sequences))
+		}
+		st = s
+	}
 	var (
 		prefix string
-		queue  <-chan []byte
+		queue  <-chan packet
 	)
 	options := []roll.Option{
 		roll.WithThreshold(settings.Roll.MaxSize, settings.Roll.MaxCount),
 		roll.WithTimeout(settings.Roll.Timeout),
 		roll.WithInterval(settings.Roll.Interval),
 	}
-	hr, err := NewWriter(settings.Dir, uint8(settings.Data.Payload), options)
+	var (
+		hr     Writer
+		closed func(string)
+	)
+	if settings.Upload.Enabled() && !settings.DryRun {
+		u, err := newUploader(settings.Dir, settings.Upload)
+		if err != nil {
+			return err
+		}
+		// closed after hr so that its last file is uploaded too
+		defer u.Close()
+		closed = u.Upload
+	}
+	if settings.DryRun {
+		hr = discardWriter{}
+	} else {
+		hr, err = NewWriter(settings.Dir, settings.Roll.Layout, uint8(settings.Data.Payload), settings.Roll.Compress, settings.Roll.Sync, closed, options)
+	}
 	if err != nil {
 		return err
 	}
 	defer hr.Close()
+
+	c, err := openSource(settings.Address, settings.Pcap, settings.Filter, settings.Socket)
+	if err != nil {
+		return err
+	}
+	if settings.Pcap {
+		// reading from a file is not subject to the bursts of a network feed
+		settings.Data.Buffer = 0
+	}
 	if settings.Data.Payload == 0 {
-		prefix = "[hrdfe]"
-		queue, err = readPackets(settings.Address, settings.Data.Queue, settings.Data.Buffer)
-		if err != nil {
-			return err
-		}
+		prefix = "hrdfe"
+		queue, _ = readPackets(c, settings.Data.Queue, settings.Data.Buffer, settings.Data.Wait, drop, NewLogger("read", settings.Log))
 	} else {
-		prefix = "[hrdp]"
-		q, err := reassemble(settings.Address, settings.Data.Queue, settings.Data.Buffer)
-		if err != nil {
-			return err
+		prefix = "hrdp"
+		q, _ := reassemble(c, settings.Data.Queue, settings.Data.Buffer, settings.Data.Limit, settings.Data.Wait, drop, NewLogger("assemble", settings.Log))
+		queue = validate(q, settings.Data.Queue, settings.Data.Keep, false, settings.Data.Stuff, settings.Data.Wait, drop, NewLogger("validate", settings.Log))
+		// only a file can be replayed: packets coming from the network are
+		// always more recent than the ones of the previous run.
+		if settings.Resume && settings.Pcap {
+			queue = skipBefore(queue, st.Watermark())
 		}
-		queue = validate(q, settings.Data.Queue, settings.Data.Keep, false)
 	}
-	return storePackets(hr, queue, prefix)
+	return storePackets(hr, queue, st, NewLogger(prefix, settings.Log))
 }
 
-func storePackets(hr Writer, queue <-chan []byte, prefix string) error {
+// storePackets writes the packets received from queue with hr. If st is not
+// nil, it is updated after each packet written and saved every 5 seconds.
+func storePackets(hr Writer, queue <-chan packet, st *state, logger Logger) error {
 	var (
 		count int
 		size  int
 		fail  int
 	)
 	go func() {
+		const row = "%s: %6d packets, %7dKB, %6d failures"
+
 		tick := time.Tick(time.Second * 5)
-		logger := log.New(os.Stderr, prefix+" ", 0)
 		for range tick {
 			if count > 0 || fail > 0 {
-				logger.Printf("%s: %6d packets, %7dKB, %6d failures", hr.Filename(), count, size>>10, fail)
+				logger.Log(row, Field{"file", hr.Filename()}, Field{"packets", count}, Field{"kb", size >> 10}, Field{"failures", fail})
 				count, size, fail = 0, 0, 0
 			}
+			if st != nil {
+				if err := st.Flush(); err != nil {
+					log.Println(err)
+				}
+			}
 		}
 	}()
-	for bs := range queue {
-		if n, err := hr.Write(bs); err != nil {
+	for p := range queue {
+		if n, err := hr.Write(p.Data); err != nil {
 			fail++
 			log.Println(err)
 		} else {
 			count++
 			size += n
+			if st != nil {
+				st.Update(hr.Filename(), p.Data)
+			}
 		}
 	}
+	if st != nil {
+		return st.Flush()
+	}
 	return nil
 }
 
 func runDump(cmd *cli.Command, args []string) error {
 	q := cmd.Flag.Int("q", 64, "queue size before dropping HRDL packets")
-	i := cmd.Flag.Int("i", -1, "hadock instance used")
+	i := instanceFlag(-1)
+	cmd.Flag.Var(&i, "i", "hadock instance used")
 	b := cmd.Flag.Int("b", 64<<20, "buffer size")
 	k := cmd.Flag.Bool("k", false, "keep invalid HRDL packets (bad sum only)")
+	f := cmd.Flag.String("L", "", "format of statistics (text, json, none)")
+	v := cmd.Flag.Bool("v", false, "print the range of cadus of each HRDL packet")
+	stuff := cmd.Flag.Bool("S", false, "discard packets with invalid stuff bytes")
+	z := cmd.Flag.Int("B", DefaultReadBuffer, "socket read buffer size")
+	proto := cmd.Flag.Bool("proto", false, "write packets as length delimited protobuf messages")
+	corr := cmd.Flag.Bool("C", false, "correlate sequence gaps with missing cadus")
+	delay := cmd.Flag.Bool("latency", false, "print delay between acquisition and reception")
+
+	var sp sampling
+	cmd.Flag.IntVar(&sp.Limit, "n", 0, "stop after n packets")
+	cmd.Flag.BoolVar(&sp.Valid, "valid", false, "count only valid packets with -n")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	queue, err := reassemble(cmd.Flag.Arg(0), *q, *b)
+	c, err := listenUDP(cmd.Flag.Arg(0), *z)
 	if err != nil {
 		return err
 	}
-	return dumpPackets(validate(queue, *q, *k, true), *i)
+	queue, _ := reassemble(c, *q, *b, DefaultPacketLimit, 0, dropNewest, NewLogger("assemble", *f))
+	queue = validate(queue, *q, *k, true, *stuff, 0, dropNewest, NewLogger("validate", *f))
+	if *proto {
+		return protoPackets(queue, os.Stdout)
+	}
+	var lat *latency
+	if *delay {
+		lat = new(latency)
+	}
+	return dumpPackets(queue, int(i), *v, *corr, sp, lat)
+}
+
+func runServe(cmd *cli.Command, args []string) error {
+	q := cmd.Flag.Int("q", 64, "queue size before dropping HRDL packets")
+	b := cmd.Flag.Int("b", 64<<20, "buffer size")
+	k := cmd.Flag.Bool("k", false, "keep invalid HRDL packets (bad sum only)")
+	f := cmd.Flag.String("L", "", "format of statistics (text, json, none)")
+	stuff := cmd.Flag.Bool("S", false, "discard packets with invalid stuff bytes")
+	addr := cmd.Flag.String("http", ":8080", "address of the HTTP server")
+	z := cmd.Flag.Int("B", DefaultReadBuffer, "socket read buffer size")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	c, err := listenUDP(cmd.Flag.Arg(0), *z)
+	if err != nil {
+		return err
+	}
+	queue, st := reassemble(c, *q, *b, DefaultPacketLimit, 0, dropNewest, NewLogger("assemble", *f))
+	br := newBroker(*q)
+	go servePackets(validate(queue, *q, *k, true, *stuff, 0, dropNewest, NewLogger("validate", *f)), br)
+
+	mux := http.NewServeMux()
+	mux.Handle("/stream", streamHandler(br))
+	mux.Handle("/stats", statsHandler(st, br))
+	return http.ListenAndServe(*addr, mux)
 }
 
 func runDebug(cmd *cli.Command, args []string) error {
 	q := cmd.Flag.Int("q", 64, "queue size before dropping HRDL packets")
-	i := cmd.Flag.Int("i", -1, "hadock instance used")
+	i := instanceFlag(-1)
+	cmd.Flag.Var(&i, "i", "hadock instance used")
+	p := cmd.Flag.Int("p", 8, "connections read concurrently")
+
+	var sp sampling
+	cmd.Flag.IntVar(&sp.Limit, "n", 0, "stop after n packets")
+	cmd.Flag.BoolVar(&sp.Valid, "valid", false, "count only valid packets with -n")
+	var opts tlsOptions
+	opts.Bind(&cmd.Flag)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	queue, err := debugHRDL(cmd.Flag.Arg(0), *q, *i)
+	cfg, err := opts.Config()
 	if err != nil {
 		return err
 	}
-	return dumpPackets(queue, *i)
+	if *p <= 0 {
+		return fmt.Errorf("invalid number of connections (%d)", *p)
+	}
+	queue, err := debugHRDL(cmd.Flag.Arg(0), *q, int(i), *p, cfg)
+	if err != nil {
+		return err
+	}
+	return dumpPackets(queue, int(i), false, false, sp, nil)
 }
 
 func runTrace(cmd *cli.Command, args []string) error {
+	f := cmd.Flag.String("L", "", "format of statistics (text, json, none)")
+	j := cmd.Flag.Bool("j", false, "print statistics as NDJSON")
+	jj := cmd.Flag.Bool("jj", false, "print statistics and cadus as NDJSON")
+	ws := cmd.Flag.String("ws", "", "push gap alerts over websocket")
+	g := cmd.Flag.Uint("g", 1, "gap threshold for alerts")
+	z := cmd.Flag.Int("B", DefaultReadBuffer, "socket read buffer size")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	return traceCadus(cmd.Flag.Arg(0))
+	var (
+		logger = NewLogger("debug", *f)
+		frames Logger
+	)
+	if *j || *jj {
+		logger = JSONLogger(os.Stdout, "trace")
+	}
+	if *jj {
+		frames = logger
+	}
+	var alerts *broker
+	if *ws != "" {
+		alerts = newBroker(64)
+		mux := http.NewServeMux()
+		mux.Handle("/", websocketHandler(alerts))
+		go func() {
+			if err := http.ListenAndServe(*ws, mux); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	return traceCadus(cmd.Flag.Arg(0), *z, logger, frames, alerts, uint32(*g))
 }
 
-func validate(queue <-chan []byte, n int, keep, strip bool) <-chan []byte {
+// validate unstuffs and verifies the HRDL packets received from queue. If stuff
+// is true, the stuff bytes of the packets are also verified and packets with
+// invalid stuff bytes are discarded.
+func validate(queue <-chan packet, n int, keep, strip, stuff bool, wait time.Duration, drop dropPolicy, logger Logger) <-chan packet {
 	var (
 		count     int64
 		size      int64
 		dropped   int64
+		evicted   int64
+		waited    int64
 		errLength int64
 		errSum    int64
+		errStuff  int64
 	)
 	go func() {
-		const row = "%6d packets, %4d dropped, %6dKB, %4d valid, %4d length error, %4d checksum error"
-		logger := log.New(os.Stderr, "[validate] ", 0)
+		const row = "%6d packets, %4d dropped, %4d evicted, %4d waited, %6dKB, %4d valid, %4d length error, %4d checksum error, %4d stuff error"
 
 		tick := time.Tick(time.Second)
 		for range tick {
-			valid := count - errLength - errSum
+			valid := count - errLength - errSum - errStuff
 			if count > 0 || dropped > 0 {
-				logger.Printf(row, count, dropped, size>>10, valid, errLength, errSum)
+				logger.Log(row,
+					Field{"packets", count},
+					Field{"dropped", dropped},
+					Field{"evicted", evicted},
+					Field{"waited", waited},
+					Field{"kb", size >> 10},
+					Field{"valid", valid},
+					Field{"length_error", errLength},
+					Field{"checksum_error", errSum},
+					Field{"stuff_error", errStuff},
+				)
 
 				count = 0
 				dropped = 0
+				evicted = 0
+				waited = 0
 				errLength = 0
 				errSum = 0
+				errStuff = 0
 				size = 0
 			}
 		}
 	}()
-	q := make(chan []byte, n)
+	q := make(chan packet, n)
 	go func() {
 		defer close(q)
 
@@ -673,8 +1842,16 @@ func validate(queue <-chan []byte, n int, keep, strip bool) <-chan []byte {
 		if strip {
 			offset = 2 * erdle.WordLen
 		}
-		for bs := range queue {
-			n, xs := erdle.Unstuff(bs)
+		for p := range queue {
+			if stuff {
+				if err := erdle.CheckStuff(p.Data); err != nil {
+					errStuff++
+					continue
+				}
+			}
+			// the packets are not shared: they are unstuffed in place
+			xs := p.Data
+			n := erdle.UnstuffInto(xs, xs)
 			z := int(binary.LittleEndian.Uint32(xs[4:])) + 12
 			if n < offset || len(xs) < z || len(xs) < 12 {
 				errLength++
@@ -692,8 +1869,15 @@ func validate(queue <-chan []byte, n int, keep, strip bool) <-chan []byte {
 					continue
 				}
 			}
-			select {
-			case q <- xs[offset:z]:
+			p.Data = xs[offset:z]
+			switch enqueue(q, p, wait, drop) {
+			case queueEvicted:
+				evicted++
+				count++
+			case queueWaited:
+				waited++
+				fallthrough
+			case queueSent:
 				count++
 			default:
 				dropped++
@@ -703,7 +1887,13 @@ func validate(queue <-chan []byte, n int, keep, strip bool) <-chan []byte {
 	return q
 }
 
-func listenUDP(addr string) (net.Conn, error) {
+// DefaultReadBuffer is the size requested for the read buffer of the UDP
+// sockets when none is given.
+const DefaultReadBuffer = 16 << 20
+
+// listenUDP opens an UDP socket on addr and requests a read buffer of size
+// bytes. The size actually granted by the kernel is logged.
+func listenUDP(addr string, size int) (net.Conn, error) {
 	a, err := net.ResolveUDPAddr(protoFromAddr(addr))
 	if err != nil {
 		return nil, err
@@ -717,101 +1907,139 @@ func listenUDP(addr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.SetReadBuffer(16 << 20); err != nil {
+	if size <= 0 {
+		size = DefaultReadBuffer
+	}
+	if err := c.SetReadBuffer(size); err != nil {
 		return nil, err
 	}
+	if z, err := readBufferSize(c); err == nil {
+		log.Printf("%s: socket read buffer: %d bytes requested, %d bytes granted", addr, size, z)
+	}
 	return c, nil
 }
 
-func reassemble(addr string, n, b int) (<-chan []byte, error) {
-	c, err := listenUDP(addr)
-	if err != nil {
-		return nil, err
+func openSource(addr string, pcap bool, filter string, size int) (io.ReadCloser, error) {
+	if pcap {
+		return PCAPReader([]string{addr}, filter)
 	}
-	q := make(chan []byte, n)
+	return listenUDP(addr, size)
+}
 
-	var r io.Reader = c
-	if b > 0 {
-		rw := ringbuffer.NewRingSize(b, 0)
-		go func(r io.Reader) {
-			io.CopyBuffer(rw, r, make([]byte, erdle.CaduLen))
-		}(r)
-		r = rw
+// reassemble reassembles the HRDL packets from the cadus read from c. Packets
+// declaring a size larger than limit are skipped (see nextPacket).
+func reassemble(c io.ReadCloser, n, b, limit int, wait time.Duration, drop dropPolicy, logger Logger) (<-chan packet, *Stats) {
+	q := make(chan packet, n)
+	if limit <= 0 {
+		limit = DefaultPacketLimit
 	}
 
-	var dropped, skipped, size, count, errCRC, errMissing int64
-	go func() {
-		const row = "%6d packets, %4d skipped, %4d dropped, %7d missing, %7d crc error, %7d bytes discarded"
-
-		logger := log.New(os.Stderr, "[assemble] ", 0)
-		tick := time.Tick(time.Second * 5)
-		for range tick {
-			err := errMissing + errCRC
-			if count > 0 || skipped > 0 || err > 0 {
-				logger.Printf(row, count, skipped, dropped, errMissing, errCRC, size)
-
-				size = 0
-				skipped = 0
-				errMissing = 0
-				errCRC = 0
-				dropped = 0
-				count = 0
-			}
-		}
-	}()
+	var st Stats
+	r := bufferSource(c, b, &st.Overflow)
+	go reportStats(&st, logger)
 
 	go func() {
 		defer func() {
 			c.Close()
 			close(q)
 		}()
-		var buffer, rest []byte
-		r := erdle.CaduReader(r, 0)
+		var (
+			buffer, rest []byte
+			err          error
+		)
+		r := newCaduCounter(r, 0)
 		for {
-			buffer, rest, err = nextPacket(r, rest)
-			if err == nil {
+			r.Start(len(rest) > 0)
+			buffer, rest, err = nextPacket(r, rest, limit)
+			if err == nil || err == ErrUndelimited {
 				if len(buffer) == 0 {
 					continue
 				}
-				select {
-				case q <- buffer:
-					count++
+				p := packet{Data: buffer}
+				p.First, p.Last = r.Range()
+				switch enqueue(q, p, wait, drop) {
+				case queueEvicted:
+					atomic.AddInt64(&st.Evicted, 1)
+					atomic.AddInt64(&st.Count, 1)
+				case queueWaited:
+					atomic.AddInt64(&st.Waited, 1)
+					fallthrough
+				case queueSent:
+					atomic.AddInt64(&st.Count, 1)
 				default:
-					dropped += 1
-					size += int64(len(buffer))
+					atomic.AddInt64(&st.Dropped, 1)
+					atomic.AddInt64(&st.Discarded, int64(len(buffer)))
 				}
 			} else if n, ok := erdle.IsMissingCadu(err); ok {
-				errMissing += int64(n)
-				size += int64(len(buffer))
-				skipped++
+				atomic.AddInt64(&st.Missing, int64(n))
+				atomic.AddInt64(&st.Discarded, int64(len(buffer)))
+				atomic.AddInt64(&st.Skipped, 1)
 			} else if erdle.IsCRCError(err) {
-				errCRC += int64(n)
-				size += int64(len(buffer))
-				skipped++
+				atomic.AddInt64(&st.CRC, 1)
+				atomic.AddInt64(&st.Discarded, int64(len(buffer)))
+				atomic.AddInt64(&st.Skipped, 1)
+			} else if erdle.IsLengthError(err) {
+				atomic.AddInt64(&st.Oversize, 1)
+				atomic.AddInt64(&st.Skipped, 1)
+			} else if err == ErrTrailerMissing {
+				// the packet can not be verified without its checksum but the
+				// error of the cadu that interrupted it is still counted
+				if n, ok := erdle.IsMissingCadu(r.Err()); ok {
+					atomic.AddInt64(&st.Missing, int64(n))
+				} else if erdle.IsCRCError(r.Err()) {
+					atomic.AddInt64(&st.CRC, 1)
+				}
+				atomic.AddInt64(&st.Discarded, int64(len(buffer)))
+				atomic.AddInt64(&st.Skipped, 1)
 			} else {
-				log.Println(err)
+				if err != io.EOF {
+					log.Println(err)
+				}
 				return
 			}
 		}
 	}()
-	return q, nil
+	return q, &st
 }
 
-func readPackets(addr string, n, b int) (<-chan []byte, error) {
-	c, err := listenUDP(addr)
-	if err != nil {
-		return nil, err
+// reportStats logs every 5 seconds the statistics of a reassembler (or of a
+// reader) collected since the previous report.
+func reportStats(st *Stats, logger Logger) {
+	const row = "%6d packets, %4d skipped, %4d dropped, %4d evicted, %4d waited, %7d missing, %7d crc error, %4d oversize, %7d bytes discarded, %7d bytes overflow"
+
+	var prev Stats
+	tick := time.Tick(time.Second * 5)
+	for range tick {
+		curr := st.Snapshot()
+		z := curr.Sub(prev)
+		if err := z.Missing + z.CRC + z.Oversize + z.Overflow; z.Count > 0 || z.Skipped > 0 || err > 0 {
+			logger.Log(row,
+				Field{"packets", z.Count},
+				Field{"skipped", z.Skipped},
+				Field{"dropped", z.Dropped},
+				Field{"evicted", z.Evicted},
+				Field{"waited", z.Waited},
+				Field{"missing", z.Missing},
+				Field{"crc_error", z.CRC},
+				Field{"oversize", z.Oversize},
+				Field{"discarded", z.Discarded},
+				Field{"overflow", z.Overflow},
+			)
+		}
+		prev = curr
 	}
-	q := make(chan []byte, n)
+}
+
+// readPackets gives the cadus read from c. Cadus following a gap are kept (the
+// gap is only counted), cadus with an invalid CRC or without magic are
+// skipped.
+func readPackets(c io.ReadCloser, n, b int, wait time.Duration, drop dropPolicy, logger Logger) (<-chan packet, *Stats) {
+	q := make(chan packet, n)
+
+	var st Stats
+	r := bufferSource(c, b, &st.Overflow)
+	go reportStats(&st, logger)
 
-	var r io.Reader = c
-	if b > 0 {
-		rw := ringbuffer.NewRingSize(b, 0)
-		go func(r io.Reader) {
-			io.CopyBuffer(rw, r, make([]byte, erdle.CaduLen))
-		}(r)
-		r = rw
-	}
 	go func() {
 		defer func() {
 			c.Close()
@@ -820,22 +2048,101 @@ func readPackets(addr string, n, b int) (<-chan []byte, error) {
 		r := erdle.VCDUReader(r, 0)
 		for {
 			body := make([]byte, erdle.CaduLen)
-			n, err := r.Read(body)
-			if n < len(body) {
+			_, err := r.Read(body)
+			if n, ok := erdle.IsMissingCadu(err); ok {
+				atomic.AddInt64(&st.Missing, int64(n))
+			} else if erdle.IsCRCError(err) || err == erdle.ErrMagic {
+				if err != erdle.ErrMagic {
+					atomic.AddInt64(&st.CRC, 1)
+				}
+				atomic.AddInt64(&st.Discarded, int64(len(body)))
+				atomic.AddInt64(&st.Skipped, 1)
 				continue
-			}
-			if err != nil {
-				if erdle.IsCaduError(err) {
-					continue
-				} else {
-					return
+			} else if err != nil && !erdle.IsOutOfOrder(err) {
+				if err != io.EOF {
+					log.Println(err)
 				}
+				return
 			}
-			select {
-			case q <- body:
+			curr := binary.BigEndian.Uint32(body[6:]) >> 8
+			switch enqueue(q, packet{Data: body, First: curr, Last: curr}, wait, drop) {
+			case queueEvicted:
+				atomic.AddInt64(&st.Evicted, 1)
+				atomic.AddInt64(&st.Count, 1)
+			case queueWaited:
+				atomic.AddInt64(&st.Waited, 1)
+				fallthrough
+			case queueSent:
+				atomic.AddInt64(&st.Count, 1)
 			default:
+				atomic.AddInt64(&st.Dropped, 1)
+				atomic.AddInt64(&st.Discarded, int64(len(body)))
 			}
 		}
 	}()
-	return q, nil
+	return q, &st
+}
+
+const (
+	queueSent = iota
+	queueWaited
+	queueDropped
+	queueEvicted
+)
+
+// dropPolicy tells which packet is dropped when a queue is full: the incoming
+// packet (dropNewest) or the oldest packet of the queue (dropOldest).
+type dropPolicy int
+
+const (
+	dropNewest dropPolicy = iota
+	dropOldest
+)
+
+func parseDropPolicy(str string) (dropPolicy, error) {
+	switch strings.ToLower(str) {
+	case "", "newest":
+		return dropNewest, nil
+	case "oldest":
+		return dropOldest, nil
+	default:
+		return dropNewest, fmt.Errorf("unrecognized drop policy %s", str)
+	}
+}
+
+// enqueue sends p to q. If q is full, it waits at most wait for room in q
+// before dropping p or, with dropOldest, the oldest packet of q to make room
+// for p.
+func enqueue(q chan packet, p packet, wait time.Duration, drop dropPolicy) int {
+	select {
+	case q <- p:
+		return queueSent
+	default:
+	}
+	if wait > 0 {
+		select {
+		case q <- p:
+			return queueWaited
+		case <-time.After(wait):
+		}
+	}
+	if drop == dropNewest {
+		return queueDropped
+	}
+	var evicted bool
+	for {
+		select {
+		case <-q:
+			evicted = true
+		default:
+		}
+		select {
+		case q <- p:
+			if evicted {
+				return queueEvicted
+			}
+			return queueSent
+		default:
+		}
+	}
 }
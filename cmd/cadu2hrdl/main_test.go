@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/cmd/internal/multireader"
+)
+
+func BenchmarkValidate(b *testing.B) {
+	bs := buildPacket(1, 1, 4096)
+
+	queue := make(chan packet)
+	q := validate(queue, 64, false, true, false, 0, dropNewest, NewLogger("bench", "none"))
+	go func() {
+		defer close(queue)
+		for i := 0; i < b.N; i++ {
+			queue <- packet{Data: append([]byte{}, bs...)}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(bs)))
+	for range q {
+	}
+}
+
+func TestOpenRTLargeRecord(t *testing.T) {
+	data := bytes.Repeat([]byte{0x11}, 9<<20)
+	dir, err := ioutil.TempDir("", "rt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rt.dat")
+	if err := ioutil.WriteFile(file, buildRecord(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := OpenRT(file, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	r := erdle.VCDUReader(rc, 0)
+	frame := make([]byte, erdle.CaduLen)
+	var count int
+	for {
+		_, err := r.Read(frame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", count+1, err)
+		}
+		count++
+	}
+	if want := (len(data) + CaduBodyLen - 1) / CaduBodyLen; count != want {
+		t.Fatalf("want %d cadus, got %d", want, count)
+	}
+}
+
+func TestVCDUReaderSplitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second cadu is split between the two files
+	stream := bytes.Join(buildCadus(1, bytes.Repeat([]byte{0x11}, 3*CaduBodyLen)), nil)
+	files := []string{filepath.Join(dir, "a.dat"), filepath.Join(dir, "b.dat")}
+	if err := ioutil.WriteFile(files[0], stream[:erdle.CaduLen+100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[1], stream[erdle.CaduLen+100:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := multireader.New(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := erdle.VCDUReader(mr, 0)
+	frame := make([]byte, erdle.CaduLen)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(frame); err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", i+1, err)
+		}
+	}
+	if _, err := r.Read(frame); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type manifest struct {
+	mu sync.Mutex
+
+	file     string
+	count    int
+	size     int
+	first    time.Time
+	last     time.Time
+	channels map[uint8]struct{}
+}
+
+func (m *manifest) Reset(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.file = file
+	m.count, m.size = 0, 0
+	m.first, m.last = time.Time{}, time.Time{}
+	m.channels = make(map[uint8]struct{})
+}
+
+func (m *manifest) Update(channel uint8, w time.Time, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.channels == nil {
+		m.channels = make(map[uint8]struct{})
+	}
+	m.count++
+	m.size += n
+	m.channels[channel] = struct{}{}
+	if m.first.IsZero() || w.Before(m.first) {
+		m.first = w
+	}
+	if w.After(m.last) {
+		m.last = w
+	}
+}
+
+// Flush writes the manifest of the current file next to it (same name but
+// with a .json extension). Nothing is written if no packets have been written
+// in the file since it will be removed.
+func (m *manifest) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == "" || m.count == 0 {
+		return nil
+	}
+	cs := make([]int, 0, len(m.channels))
+	for c := range m.channels {
+		cs = append(cs, int(c))
+	}
+	sort.Ints(cs)
+
+	v := struct {
+		File     string    `json:"file"`
+		Count    int       `json:"packets"`
+		Size     int       `json:"size"`
+		Channels []int     `json:"channels"`
+		First    time.Time `json:"first"`
+		Last     time.Time `json:"last"`
+	}{
+		File:     filepath.Base(m.file),
+		Count:    m.count,
+		Size:     m.size,
+		Channels: cs,
+		First:    m.first,
+		Last:     m.last,
+	}
+	file := strings.TrimSuffix(m.file, ".gz")
+	w, err := os.Create(strings.TrimSuffix(file, filepath.Ext(file)) + ".json")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
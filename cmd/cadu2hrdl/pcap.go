@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/cmd/internal/capture"
+	"github.com/google/gopacket/layers"
+)
+
+type pcapReader struct {
+	handle *capture.Handle
+	filter string
+	files  []string
+	when   time.Time
+	// rest holds the cadus of the last datagram not read yet.
+	rest []byte
+}
+
+func PCAPReader(files []string, filter string) (io.ReadCloser, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files given")
+	}
+	r := pcapReader{
+		filter: filter,
+		files:  files[1:],
+	}
+	if err := r.open(files[0]); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *pcapReader) Close() error {
+	if r.handle == nil {
+		return nil
+	}
+	return r.handle.Close()
+}
+
+func (r *pcapReader) Read(bs []byte) (int, error) {
+	if len(r.rest) > 0 {
+		n := copy(bs, r.rest)
+		r.rest = r.rest[n:]
+		return n, nil
+	}
+	for {
+		if r.handle == nil {
+			return 0, io.EOF
+		}
+		p, err := r.handle.NextPacket()
+		if err == io.EOF {
+			r.handle.Close()
+			r.handle = nil
+			if len(r.files) > 0 {
+				if err := r.open(r.files[0]); err != nil {
+					return 0, err
+				}
+				r.files = r.files[1:]
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if p.Layer(layers.LayerTypeUDP) == nil {
+			continue
+		}
+		layer := p.ApplicationLayer()
+		if layer == nil {
+			continue
+		}
+		if xs := layer.Payload(); bytes.HasPrefix(xs, erdle.Magic) {
+			r.when = p.Metadata().Timestamp
+			// a datagram can carry several cadus
+			n := copy(bs, xs)
+			r.rest = xs[n:]
+			return n, nil
+		}
+	}
+}
+
+// pacedReader gives the cadus read from a pcapReader with the timing of their
+// capture. Delays between cadus are divided by speed.
+type pacedReader struct {
+	*pcapReader
+	speed float64
+
+	first time.Time
+	start time.Time
+}
+
+func PacedReader(r io.ReadCloser, speed float64) (io.ReadCloser, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("invalid speed (%f)", speed)
+	}
+	p, ok := r.(*pcapReader)
+	if !ok {
+		return nil, fmt.Errorf("recorded timing only available for pcap files")
+	}
+	return &pacedReader{pcapReader: p, speed: speed}, nil
+}
+
+func (r *pacedReader) Read(bs []byte) (int, error) {
+	n, err := r.pcapReader.Read(bs)
+	if err != nil {
+		return n, err
+	}
+	if r.first.IsZero() {
+		r.first, r.start = r.when, time.Now()
+		return n, err
+	}
+	// sleeping until the scheduled time of each cadu (instead of the delay
+	// since the previous one) avoids to accumulate the drifts of time.Sleep.
+	delay := time.Duration(float64(r.when.Sub(r.first)) / r.speed)
+	if wait := time.Until(r.start.Add(delay)); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (r *pcapReader) open(file string) error {
+	h, err := capture.Open(file)
+	if err != nil {
+		return err
+	}
+	if r.filter != "" {
+		if err := h.SetBPFFilter(r.filter); err != nil {
+			h.Close()
+			return err
+		}
+	}
+	r.handle = h
+	return nil
+}
@@ -2,86 +2,198 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/busoc/erdle"
 	"github.com/juju/ratelimit"
 	"github.com/midbel/rustine/sum"
 )
 
+// pool distributes the packets over its connections in a round-robin fashion.
+// A connection that fails is closed and reopened the next time its turn comes.
 type pool struct {
 	addr     string
 	instance int
 	rate     int
-	queue    chan net.Conn
+	slots    []slot
+	next     uint32
+	idle     time.Duration
+
+	ack   bool
+	nacks int64
+
+	tls *tls.Config
 }
 
-func NewPool(a string, n, i, r int) (*pool, error) {
-	if n < 1 {
-		return nil, fmt.Errorf("number of connections too small")
+// NewPool creates a pool of n connections to a. Connections that have not been
+// used for more than idle are closed and reopened before being used again. A
+// zero idle keeps the connections open indefinitely.
+func NewPool(a string, n, i, r int, idle time.Duration, ack bool, cfg *tls.Config) (*pool, error) {
+	p, err := newPool(a, n, i, r, idle, ack, cfg)
+	if err != nil {
+		return nil, err
 	}
-	q := make(chan net.Conn, n)
-	for j := 0; j < n; j++ {
-		c, err := client(a, i, r)
+	for j := range p.slots {
+		c, err := p.client()
 		if err != nil {
 			return nil, err
 		}
-		q <- c
+		p.slots[j].conn = c
+	}
+	return p, nil
+}
+
+type slot struct {
+	mu   sync.Mutex
+	conn *conn
+}
+
+// newPool creates a pool without connections. They are opened on the first
+// writes.
+func newPool(a string, n, i, r int, idle time.Duration, ack bool, cfg *tls.Config) (*pool, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of connections too small")
+	}
+	if err := checkInstance(i); err != nil {
+		return nil, err
 	}
 	p := pool{
 		addr:     a,
-		queue:    q,
+		slots:    make([]slot, n),
 		rate:     r,
 		instance: i,
+		idle:     idle,
+		ack:      ack,
+		tls:      cfg,
 	}
 	return &p, nil
 }
 
-func (p *pool) Write(bs []byte) (int, error) {
-	c, err := p.pop()
-	if err != nil {
-		return 0, err
+// Nacks gives the number of packets rejected by the remote server(s).
+func (p *pool) Nacks() int64 {
+	return atomic.LoadInt64(&p.nacks)
+}
+
+func (p *pool) client() (*conn, error) {
+	c, err := client(p.addr, p.instance, p.rate, p.tls)
+	if err != nil || !p.ack || p.instance < 0 {
+		return c, err
 	}
+	go readAcks(c, &p.nacks)
+	return c, nil
+}
+
+// fanout writes packets to a primary pool and mirrors them to secondary pools.
+// Packets are given to the secondaries via a queue and are dropped when the
+// queue of a secondary is full so that a slow or failing secondary never
+// blocks the primary.
+type fanout struct {
+	*pool
+	mirrors []*mirror
+}
+
+type mirror struct {
+	*pool
+	queue   chan []byte
+	dropped int64
+	failed  int64
+}
 
-	n, err := c.Write(bs)
+// NewFanout creates a fanout for the comma separated list of addresses given in
+// a. Only the first address is required to be reachable.
+func NewFanout(a string, n, i, r, q int, idle time.Duration, ack bool, cfg *tls.Config) (*fanout, error) {
+	as := strings.Split(a, ",")
+	p, err := NewPool(strings.TrimSpace(as[0]), n, i, r, idle, ack, cfg)
 	if err != nil {
-		c.Close()
-	} else {
-		p.push(c)
+		return nil, err
 	}
-	return n, err
+	f := fanout{pool: p}
+	for _, a := range as[1:] {
+		p, err := newPool(strings.TrimSpace(a), n, i, r, idle, ack, cfg)
+		if err != nil {
+			return nil, err
+		}
+		m := mirror{
+			pool:  p,
+			queue: make(chan []byte, q),
+		}
+		go m.run()
+		f.mirrors = append(f.mirrors, &m)
+	}
+	return &f, nil
 }
 
-func (p *pool) pop() (net.Conn, error) {
-	select {
-	case c := <-p.queue:
-		return c, nil
-	default:
-		return client(p.addr, p.instance, p.rate)
+func (f *fanout) Write(bs []byte) (int, error) {
+	for _, m := range f.mirrors {
+		select {
+		case m.queue <- bs:
+		default:
+			atomic.AddInt64(&m.dropped, 1)
+		}
 	}
+	return f.pool.Write(bs)
 }
 
-func (p *pool) push(c net.Conn) {
-	select {
-	case p.queue <- c:
-	default:
-		c.Close()
+func (m *mirror) run() {
+	for bs := range m.queue {
+		if _, err := m.pool.Write(bs); err != nil {
+			n := atomic.AddInt64(&m.failed, 1)
+			log.Printf("%s: %s (%d failures, %d dropped)", m.addr, err, n, atomic.LoadInt64(&m.dropped))
+		}
 	}
 }
 
+func (p *pool) Write(bs []byte) (int, error) {
+	i := atomic.AddUint32(&p.next, 1) % uint32(len(p.slots))
+	s := &p.slots[i]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && p.idle > 0 && time.Since(s.conn.last) > p.idle {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		c, err := p.client()
+		if err != nil {
+			return 0, err
+		}
+		s.conn = c
+	}
+	n, err := s.conn.Write(bs)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return n, err
+}
+
 type conn struct {
 	net.Conn
 	inner    io.Writer
 	next     uint16
 	preamble uint16
+	last     time.Time
 
 	writePacket func(*conn, []byte) (int, error)
 }
 
-func client(a string, i, r int) (net.Conn, error) {
+// client connects to a. Since the pool reconnects by calling client, the
+// connections recreated after a failure are also secured with TLS when cfg is
+// not nil.
+func client(a string, i, r int, cfg *tls.Config) (*conn, error) {
 	var (
 		preamble  uint16
 		writeFunc func(*conn, []byte) (int, error)
@@ -93,9 +205,9 @@ func client(a string, i, r int) (net.Conn, error) {
 	case -1:
 		writeFunc = writeHRDL
 	default:
-		return nil, fmt.Errorf("invalid instance (%d)", i)
+		return nil, checkInstance(i)
 	}
-	c, err := net.Dial(protoFromAddr(a))
+	c, err := dial(a, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -107,12 +219,78 @@ func client(a string, i, r int) (net.Conn, error) {
 		Conn:        c,
 		inner:       w,
 		preamble:    preamble,
+		last:        time.Now(),
 		writePacket: writeFunc,
 	}, nil
 }
 
+// the versions are written on 4 bits in the preamble: the conversions fail to
+// compile if one of them is too large.
+const _ = uint8(0xF-hdkVersion) + uint8(0xF-vmuVersion)
+
+// instanceNames gives the names of the hadock instances. Instance -1 is used to
+// send the HRDL packets without the hadock header.
+var instanceNames = map[int]string{
+	0:   "test",
+	1:   "sim1",
+	2:   "sim2",
+	255: "ops",
+}
+
+// checkInstance verifies that i is a hadock instance or -1.
+func checkInstance(i int) error {
+	if _, ok := instanceNames[i]; ok || i == -1 {
+		return nil
+	}
+	is := make([]int, 0, len(instanceNames))
+	for j := range instanceNames {
+		is = append(is, j)
+	}
+	sort.Ints(is)
+
+	vs := make([]string, 0, len(is)+1)
+	for _, j := range is {
+		vs = append(vs, fmt.Sprintf("%d (%s)", j, instanceNames[j]))
+	}
+	vs = append(vs, "-1 (no hadock header)")
+	return fmt.Errorf("invalid instance %d: expected one of %s", i, strings.Join(vs, ", "))
+}
+
+// parseInstance parses a hadock instance given by its value or by its name.
+func parseInstance(str string) (int, error) {
+	for i, n := range instanceNames {
+		if strings.EqualFold(n, str) {
+			return i, nil
+		}
+	}
+	i, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid instance %s: expected test, sim1, sim2, ops or a number", str)
+	}
+	return i, checkInstance(i)
+}
+
+// instanceFlag is the flag of the hadock instance that accepts the names of
+// the instances as well as their values.
+type instanceFlag int
+
+func (i *instanceFlag) Set(str string) error {
+	n, err := parseInstance(str)
+	if err == nil {
+		*i = instanceFlag(n)
+	}
+	return err
+}
+
+func (i *instanceFlag) String() string {
+	return strconv.Itoa(int(*i))
+}
+
 func (c *conn) Write(bs []byte) (int, error) {
-	defer func() { c.next++ }()
+	defer func() {
+		c.next++
+		c.last = time.Now()
+	}()
 	return c.writePacket(c, bs)
 }
 
@@ -140,3 +318,32 @@ func writeHadock(c *conn, bs []byte) (int, error) {
 	n, err := io.Copy(c.Conn, &buf)
 	return int(n), err
 }
+
+// ackLen is the length of the frames sent back by hadock for each packet. An
+// ack frame is made of (all fields in big endian):
+//
+//   - the synchronization word (4 bytes)
+//   - the preamble of the acknowledged packet (2 bytes)
+//   - the sequence counter of the acknowledged packet (2 bytes)
+//   - a status: 0 when the packet is accepted, any other value otherwise (1 byte)
+const ackLen = erdle.WordLen + 5
+
+// readAcks reads the ack frames sent by hadock on c until c is closed and
+// counts the packets rejected in nacks.
+func readAcks(c *conn, nacks *int64) {
+	buf := make([]byte, ackLen)
+	for {
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return
+		}
+		if !bytes.Equal(buf[:erdle.WordLen], erdle.Word) {
+			log.Printf("%s: invalid ack frame (%x)", c.RemoteAddr(), buf)
+			continue
+		}
+		if status := buf[ackLen-1]; status != 0 {
+			atomic.AddInt64(nacks, 1)
+			seq := binary.BigEndian.Uint16(buf[erdle.WordLen+2:])
+			log.Printf("%s: packet %d rejected (status: %02x)", c.RemoteAddr(), seq, status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progress counts the bytes read from the underlying reader in order to report
+// periodically on stderr the progress of long scans.
+type progress struct {
+	io.Reader
+	read int64
+}
+
+func (p *progress) Read(bs []byte) (int, error) {
+	n, err := p.Reader.Read(bs)
+	atomic.AddInt64(&p.read, int64(n))
+	return n, err
+}
+
+// Report prints every second the number of bytes read, the number of packets
+// given by packets and the reading rate. If total is greater than zero, the
+// percentage of bytes read is also printed. Reporting stops when the returned
+// function is called.
+func (p *progress) Report(total int64, packets func() int) func() {
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+
+		now := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			read := atomic.LoadInt64(&p.read)
+			rate := float64(read>>20) / time.Since(now).Seconds()
+			if total > 0 {
+				fmt.Fprintf(os.Stderr, "[progress] %dMB/%dMB (%.1f%%), %d packets, %.2fMB/s\n", read>>20, total>>20, float64(read)*100/float64(total), packets(), rate)
+			} else {
+				fmt.Fprintf(os.Stderr, "[progress] %dMB, %d packets, %.2fMB/s\n", read>>20, packets(), rate)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Wrap gives a reader that reads from r and counts the bytes read in p (when
+// several readers are read at the same time).
+func (p *progress) Wrap(r io.Reader) io.Reader {
+	return progressReader{Reader: r, read: &p.read}
+}
+
+type progressReader struct {
+	io.Reader
+	read *int64
+}
+
+func (p progressReader) Read(bs []byte) (int, error) {
+	n, err := p.Reader.Read(bs)
+	atomic.AddInt64(p.read, int64(n))
+	return n, err
+}
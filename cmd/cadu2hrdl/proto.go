@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/busoc/erdle"
+)
+
+// wire types of the protobuf encoding.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// protoPackets writes the HRDL packets received from queue to w as length
+// delimited Erdle messages (see erdle.proto). Packets whose headers can not be
+// decoded are skipped.
+func protoPackets(queue <-chan packet, w io.Writer) error {
+	var buf, msg []byte
+	for p := range queue {
+		h, err := erdle.DecodeHRDLHeader(p.Data)
+		if err != nil {
+			continue
+		}
+		msg = marshalErdle(msg[:0], h, p)
+
+		buf = appendUvarint(buf[:0], uint64(len(msg)))
+		buf = append(buf, msg...)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalErdle appends to bs the protobuf encoding of the Erdle message of p.
+// As in proto3, fields with a zero value are not written.
+func marshalErdle(bs []byte, h erdle.HRDLHeader, p packet) []byte {
+	bs = appendVarint(bs, 1, uint64(h.Channel))
+	bs = appendVarint(bs, 2, uint64(h.Source))
+	bs = appendVarint(bs, 3, uint64(h.Sequence))
+	bs = appendVarint(bs, 4, uint64(unixNano(h.When)))
+	bs = appendVarint(bs, 5, uint64(h.Type()))
+	bs = appendVarint(bs, 6, uint64(h.Origin))
+	bs = appendVarint(bs, 7, uint64(h.Counter))
+	bs = appendVarint(bs, 8, uint64(unixNano(h.Acqtime)))
+	bs = appendBytes(bs, 9, []byte(h.UPI))
+	bs = appendVarint(bs, 10, uint64(p.First))
+	bs = appendVarint(bs, 11, uint64(p.Last))
+	bs = appendBytes(bs, 12, p.Data)
+	return bs
+}
+
+func appendVarint(bs []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return bs
+	}
+	bs = appendUvarint(bs, uint64(field<<3|wireVarint))
+	return appendUvarint(bs, v)
+}
+
+func appendBytes(bs []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return bs
+	}
+	bs = appendUvarint(bs, uint64(field<<3|wireBytes))
+	bs = appendUvarint(bs, uint64(len(v)))
+	return append(bs, v...)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func appendUvarint(bs []byte, v uint64) []byte {
+	for v >= 0x80 {
+		bs = append(bs, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(bs, byte(v))
+}
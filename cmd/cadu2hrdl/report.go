@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/busoc/erdle"
+	"github.com/busoc/timutil"
 	"github.com/busoc/vmu"
+	"golang.org/x/sync/errgroup"
 )
 
 type coze struct {
@@ -16,22 +26,136 @@ type coze struct {
 	Size    int
 	Invalid int
 	Missing uint32
+	// Realtime and Playback are only set for HRDL packets (see
+	// erdle.HRDLHeader.Realtime).
+	Realtime int
+	Playback int
+	// Truncated is the number of HRDL packets without checksum (see
+	// ErrTrailerMissing).
+	Truncated int
 }
 
 func (c *coze) Update(z *coze) {
 	c.Count += z.Count
 	c.Size += z.Size
+	c.Invalid += z.Invalid
 	c.Missing += z.Missing
+	c.Realtime += z.Realtime
+	c.Playback += z.Playback
+	c.Truncated += z.Truncated
 }
 
-func countCadus(r io.Reader) error {
+// updateMode counts the packet h as a realtime or as a playback packet.
+func (c *coze) updateMode(h erdle.HRDLHeader) {
+	if h.Realtime() {
+		c.Realtime++
+	} else {
+		c.Playback++
+	}
+}
+
+// strict defines which errors should abort the commands instead of being
+// counted.
+type strict struct {
+	Enabled bool
+	Missing bool
+}
+
+func (s strict) Fail(err error) bool {
+	if !s.Enabled || err == nil {
+		return false
+	}
+	if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsOutOfOrder(err) {
+		return s.Missing
+	}
+	return true
+}
+
+// sampling stops the commands after Limit packets (or after Limit valid packets
+// if Valid is true). A Limit that is not positive never stops them.
+type sampling struct {
+	Limit int
+	Valid bool
+	count int
+}
+
+// Done counts a packet and reports whether the limit has been reached.
+func (s *sampling) Done(valid bool) bool {
+	if s.Limit <= 0 {
+		return false
+	}
+	if valid || !s.Valid {
+		s.count++
+	}
+	return s.count >= s.Limit
+}
+
+// latency keeps the minimum, the maximum and the mean of the delays between the
+// acquisition time of the packets and their reception time.
+type latency struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	total time.Duration
+}
+
+// Update decodes the header of the HRDL packet bs and gives the delay between
+// its acquisition time and recv. It reports false if the header is invalid or
+// if the packet has no acquisition time.
+func (l *latency) Update(bs []byte, recv time.Time) (time.Duration, bool) {
+	h, err := erdle.DecodeHRDLHeader(bs)
+	if err != nil || h.Acqtime.IsZero() {
+		return 0, false
+	}
+	d := recv.Sub(h.Acqtime)
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if l.Count == 0 || d > l.Max {
+		l.Max = d
+	}
+	l.Count++
+	l.total += d
+	return d, true
+}
+
+func (l *latency) String() string {
+	if l.Count == 0 {
+		return "latency: no packets with an acquisition time"
+	}
+	avg := l.total / time.Duration(l.Count)
+	return fmt.Sprintf("latency: min %s, avg %s, max %s (%d packets)", l.Min, avg, l.Max, l.Count)
+}
+
+// countCadus reports the number of cadus read from r. If nofill is true, the
+// fill frames (see erdle.IsFillCadu) are not included in the number of cadus
+// (they are still used to detect the missing cadus).
+func countCadus(r io.Reader, st strict, nofill bool) error {
+	if !st.Enabled {
+		s, err := erdle.Survey(r)
+		if err != nil {
+			return err
+		}
+		frames := s.Frames
+		if nofill {
+			frames -= s.Fill
+		}
+		log.Printf("%d cadus (expected: %d, %.2f%%), missing: %d, invalid: %d, reordered: %d, fill: %d (%d - %d)", frames, s.Expected(), s.Completeness()*100, s.Missing, s.CRC, s.Reordered, s.Fill, s.First, s.Last)
+		return nil
+	}
 	body := make([]byte, 1024)
-	var z coze
+	var (
+		z    coze
+		fill int
+	)
 	for {
 		n, err := r.Read(body)
 		if err == io.EOF {
 			break
 		}
+		if st.Fail(err) {
+			return err
+		}
 		if n, ok := erdle.IsMissingCadu(err); ok {
 			z.Missing += uint32(n)
 			continue
@@ -40,95 +164,796 @@ func countCadus(r io.Reader) error {
 			z.Invalid++
 			continue
 		}
-		if err != nil {
+		if err != nil && !erdle.IsOutOfOrder(err) {
 			return err
 		}
+		if erdle.IsFillCadu(body[:n], 0) {
+			fill++
+			if nofill {
+				continue
+			}
+		}
 		z.Count++
 		z.Size += n
 	}
-	log.Printf("%d cadus, missing: %d, invalid: %d (%dKB)", z.Count, z.Missing, z.Invalid, z.Size>>10)
+	log.Printf("%d cadus, missing: %d, invalid: %d, fill: %d (%dKB)", z.Count, z.Missing, z.Invalid, fill, z.Size>>10)
 	return nil
 }
 
-func countHRDL(r io.Reader, by string) error {
+// countHRDL reports the number of packets by channel, by origin or by UPI. If
+// headers is true, only the headers of the packets are decoded: their checksum
+// is not verified. The readers of rs are decoded by par goroutines at most and
+// their counts are merged in the order of rs (see hrdlCounts.Merge): each
+// reader should start with the first cadu of a packet.
+func countHRDL(rs []io.Reader, by string, headers bool, par int, st strict) error {
 	var byFunc func(bs []byte) (byte, uint32)
 	switch by {
 	case "origin", "source":
 		byFunc = byOrigin
 	case "channel", "":
 		byFunc = byChannel
+	case "upi":
+		return countUPI(rs, headers, par, st)
 	default:
 		return fmt.Errorf("unrecognized value %s", by)
 	}
+	cs := make([]*hrdlCounts, len(rs))
+	err := eachReader(rs, par, func(j int, r io.Reader) error {
+		c, err := scanHRDL(r, byFunc, headers, st)
+		cs[j] = c
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	for _, o := range cs[1:] {
+		c.Merge(o)
+	}
+	for i, e := range c.zs {
+		log.Printf("%02x: %7d packets (%7d realtime, %7d playback), %7d missing, %4d invalid, %d truncated, %7dMB", i, e.Count, e.Realtime, e.Playback, e.Missing, e.Invalid, e.Truncated, e.Size>>20)
+	}
+	warnUndelimited(rs[len(rs)-1])
+	return nil
+}
 
-	zs := make(map[byte]*coze)
-	ps := make(map[byte]uint32)
+// hrdlCounts are the counts of the packets by channel or by origin. The first
+// and the last sequence counters of each of them are kept to count the packets
+// missing between the counts of two readers.
+type hrdlCounts struct {
+	zs    map[byte]*coze
+	first map[byte]uint32
+	last  map[byte]uint32
+}
 
+// Merge adds the counts of o to c. The packets of o are expected to follow the
+// packets of c.
+func (c *hrdlCounts) Merge(o *hrdlCounts) {
+	for i, z := range o.zs {
+		e, ok := c.zs[i]
+		if !ok {
+			c.zs[i], c.first[i], c.last[i] = z, o.first[i], o.last[i]
+			continue
+		}
+		e.Update(z)
+		if diff := o.first[i] - c.last[i]; diff > 1 {
+			e.Missing += diff - 1
+		}
+		c.last[i] = o.last[i]
+	}
+}
+
+func scanHRDL(r io.Reader, byFunc func([]byte) (byte, uint32), headers bool, st strict) (*hrdlCounts, error) {
+	c := hrdlCounts{
+		zs:    make(map[byte]*coze),
+		first: make(map[byte]uint32),
+		last:  make(map[byte]uint32),
+	}
 	body := make([]byte, 8<<20)
-	for i := 1; ; i++ {
-		n, err := r.Read(body)
-		if err != nil {
+	for {
+		n, z, err := nextHRDL(r, &body, headers)
+		truncated := err == ErrTrailerMissing
+		if err != nil && !truncated {
 			if err == io.EOF {
 				break
 			}
-			if _, ok := erdle.IsMissingCadu(err); ok {
+			if _, ok := erdle.IsMissingCadu(err); (ok || erdle.IsLengthError(err)) && !st.Fail(err) {
 				continue
 			}
-			return err
+			return nil, err
 		}
 
 		i, s := byFunc(body[8:])
-		if _, ok := zs[i]; !ok {
-			zs[i] = &coze{}
+		e, ok := c.zs[i]
+		if !ok {
+			e = &coze{}
+			c.zs[i], c.first[i] = e, s
+		} else if diff := s - c.last[i]; diff > 1 {
+			e.Missing += diff - 1
+		}
+		c.last[i] = s
+		if h, err := erdle.DecodeHRDLHeader(body[:n]); err == nil {
+			e.updateMode(h)
 		}
-		if z := binary.LittleEndian.Uint32(body[4:]) + 12; int(z) != n {
-			zs[i].Invalid++
+		if truncated {
+			// the checksum is missing and can not be verified
+			e.Truncated++
+		} else if w := binary.LittleEndian.Uint32(body[4:]) + 12; int(w) != z {
+			if err := (erdle.LengthError{Want: int(w), Got: z}); st.Fail(err) {
+				return nil, err
+			}
+			e.Invalid++
+		} else if headers {
+			// checksum can not be verified without the payload
 		} else if s := vmu.Sum(body[8 : n-4]); s != binary.LittleEndian.Uint32(body[n-4:]) {
-			zs[i].Invalid++
+			if err := checksumError(r, binary.LittleEndian.Uint32(body[n-4:]), s); st.Fail(err) {
+				return nil, err
+			}
+			e.Invalid++
+		}
+		e.Count++
+		e.Size += z - 12
+	}
+	return &c, nil
+}
+
+// unknownUPI is the bucket of the packets that have no UPI (packets that are
+// neither science nor image packets).
+const unknownUPI = "UNKNOWN"
+
+type upiCoze struct {
+	coze
+	First time.Time
+	Last  time.Time
+}
+
+// Update adds the counts of z and extends the time span with the one of z.
+func (c *upiCoze) Update(z *upiCoze) {
+	c.coze.Update(&z.coze)
+	if c.First.IsZero() || (!z.First.IsZero() && z.First.Before(c.First)) {
+		c.First = z.First
+	}
+	if z.Last.After(c.Last) {
+		c.Last = z.Last
+	}
+}
+
+// countUPI reports the number of packets, their size and the time span of
+// their acquisition time for each UPI found in the packets read from rs (see
+// countHRDL).
+func countUPI(rs []io.Reader, headers bool, par int, st strict) error {
+	cs := make([]map[string]*upiCoze, len(rs))
+	err := eachReader(rs, par, func(j int, r io.Reader) error {
+		zs, err := scanUPI(r, headers, st)
+		cs[j] = zs
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	zs := cs[0]
+	for _, o := range cs[1:] {
+		for u, z := range o {
+			if c, ok := zs[u]; ok {
+				c.Update(z)
+			} else {
+				zs[u] = z
+			}
 		}
+	}
+	us := make([]string, 0, len(zs))
+	for u := range zs {
+		us = append(us, u)
+	}
+	sort.Strings(us)
+	for _, u := range us {
+		e := zs[u]
+		log.Printf("%-32s: %7d packets (%7d realtime, %7d playback), %4d invalid, %d truncated, %7dMB, %s - %s (%s)", u, e.Count, e.Realtime, e.Playback, e.Invalid, e.Truncated, e.Size>>20, e.First.Format(time.RFC3339), e.Last.Format(time.RFC3339), e.Last.Sub(e.First))
+	}
+	warnUndelimited(rs[len(rs)-1])
+	return nil
+}
 
-		zs[i].Count++
-		zs[i].Size += n - 12
-		if diff := s - ps[i]; diff != s && diff > 1 {
-			zs[i].Missing += diff - 1
+func scanUPI(r io.Reader, headers bool, st strict) (map[string]*upiCoze, error) {
+	zs := make(map[string]*upiCoze)
+
+	body := make([]byte, 8<<20)
+	for {
+		n, z, err := nextHRDL(r, &body, headers)
+		truncated := err == ErrTrailerMissing
+		if err != nil && !truncated {
+			if err == io.EOF {
+				break
+			}
+			if _, ok := erdle.IsMissingCadu(err); (ok || erdle.IsLengthError(err)) && !st.Fail(err) {
+				continue
+			}
+			return nil, err
+		}
+		h, err := erdle.DecodeHRDLHeader(body[:n])
+		if err != nil {
+			if st.Fail(err) {
+				return nil, err
+			}
+			continue
+		}
+		upi := h.UPI
+		if h.Type() == erdle.TypeUnknown || upi == "" {
+			upi = unknownUPI
+		}
+		c, ok := zs[upi]
+		if !ok {
+			c = &upiCoze{}
+			zs[upi] = c
+		}
+		if truncated {
+			// the checksum is missing and can not be verified
+			c.Truncated++
+		} else if w := binary.LittleEndian.Uint32(body[4:]) + 12; int(w) != z {
+			if err := (erdle.LengthError{Want: int(w), Got: z}); st.Fail(err) {
+				return nil, err
+			}
+			c.Invalid++
+		} else if headers {
+			// checksum can not be verified without the payload
+		} else if s := vmu.Sum(body[8 : n-4]); s != binary.LittleEndian.Uint32(body[n-4:]) {
+			if err := checksumError(r, binary.LittleEndian.Uint32(body[n-4:]), s); st.Fail(err) {
+				return nil, err
+			}
+			c.Invalid++
+		}
+		c.Count++
+		c.Size += z - 12
+		c.updateMode(h)
+		if c.First.IsZero() || h.Acqtime.Before(c.First) {
+			c.First = h.Acqtime
+		}
+		if h.Acqtime.After(c.Last) {
+			c.Last = h.Acqtime
 		}
 	}
-	for i, e := range zs {
-		log.Printf("%02x: %7d packets, %7d missing, %4d invalid, %7dMB", i, e.Count, e.Missing, e.Invalid, e.Size>>20)
+	return zs, nil
+}
+
+// checkAligned checks that each file only contains whole cadus (each of them
+// preceded by skip bytes) so that its packets can be decoded without the
+// other files.
+func checkAligned(files []string, skip int) error {
+	magic := make([]byte, len(erdle.Magic))
+	for _, f := range files {
+		r, err := os.Open(f)
+		if err != nil {
+			return err
+		}
+		i, err := r.Stat()
+		if err == nil {
+			_, err = r.ReadAt(magic, int64(skip))
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		if i.Size()%int64(skip+erdle.CaduLen) != 0 || !bytes.Equal(magic, erdle.Magic) {
+			return fmt.Errorf("%s: not aligned on cadus", f)
+		}
 	}
 	return nil
 }
 
-func listHRDL(r io.Reader, raw bool) error {
+// eachReader calls fn with each reader of rs (and its index), par calls at most
+// running at the same time. It gives the first error returned by fn.
+func eachReader(rs []io.Reader, par int, fn func(int, io.Reader) error) error {
+	if par < 1 {
+		par = 1
+	}
+	var (
+		grp  errgroup.Group
+		sema = make(chan struct{}, par)
+	)
+	for j, r := range rs {
+		j, r := j, r
+		sema <- struct{}{}
+		grp.Go(func() error {
+			defer func() { <-sema }()
+			return fn(j, r)
+		})
+	}
+	return grp.Wait()
+}
+
+// checksumError creates the ChecksumError of the last packet read from r. The
+// cadus that carried the packet are given when r reassembles the packets from
+// cadus (see hrdlReader).
+func checksumError(r io.Reader, want, got uint32) error {
+	err := erdle.ChecksumError{Want: want, Got: got}
+	if p, ok := r.(*hrdlReader); ok {
+		err.FirstCadu, err.LastCadu = p.Cadus()
+		err.Located = true
+	}
+	return err
+}
+
+// nextHRDL reads the next packet from r in body (only its headers if headers
+// is true). It gives the number of bytes read in body and the length of the
+// packet.
+func nextHRDL(r io.Reader, body *[]byte, headers bool) (int, int, error) {
+	if headers {
+		return readHeaders(r, *body)
+	}
+	n, err := readPacket(r, body)
+	return n, n, err
+}
+
+// listHRDL prints the headers of the HRDL packets read from r. If lat is not
+// nil, the delay between the acquisition and the reception of each packet is
+// printed too (r should then track the reception time, see reception).
+func listHRDL(r io.Reader, raw bool, st strict, sp sampling, lat *latency) error {
 	body := make([]byte, vmu.BufferSize)
-	var total, size, errCRC, errMissing, errInvalid, errLength int
+	var total, size, errCRC, errMissing, errInvalid, errLength, errTrailer int
 
 	d := vmu.Dump(os.Stdout, false)
 	for i := 1; ; i++ {
-		n, err := r.Read(body)
+		n, err := readPacket(r, &body)
 
 		size += n
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if st.Fail(err) {
+				return err
+			}
 			if n, ok := erdle.IsMissingCadu(err); ok {
 				errMissing += n
 			} else if erdle.IsCRCError(err) {
 				errCRC++
+			} else if erdle.IsLengthError(err) {
+				errLength++
+				continue
+			} else if err == ErrTrailerMissing {
+				errTrailer++
 			} else {
 				return err
 			}
 		}
 		total++
+		if recv, ok := reception(r); ok {
+			// the reception time is printed before the headers of the packet
+			fmt.Fprintf(os.Stdout, "%s | ", recv.Format("2006-01-02 15:04:05"))
+			if lat != nil {
+				if d, ok := lat.Update(body[:n], recv); ok {
+					fmt.Fprintf(os.Stdout, "%12s | ", d.Round(time.Millisecond))
+				} else {
+					fmt.Fprintf(os.Stdout, "%12s | ", "-")
+				}
+			}
+		}
+		valid := err == nil
 		if err := d.Dump(body[:n], true, raw); err != nil {
+			if st.Fail(err) {
+				return err
+			}
 			if err == vmu.ErrInvalid {
 				errInvalid++
 			} else {
 				errLength++
 			}
+			valid = false
 		}
+		if sp.Done(valid) {
+			break
+		}
+	}
+	log.Printf("%d HRDL packets, %d invalid cks, %d invalid len, %d without cks (%d KB, %d missing cadus, %d corrupted)", total, errInvalid, errLength, errTrailer, size>>10, errMissing, errCRC)
+	if lat != nil {
+		log.Print(lat)
+	}
+	warnUndelimited(r)
+	return nil
+}
+
+// reception gives the reception time of the last packet read from r. It
+// reports false if r does not track it (see HRDFEReader and hrdpReader).
+func reception(r io.Reader) (time.Time, bool) {
+	switch r := r.(type) {
+	case *hrdlReader:
+		return r.Reception(), r.stamps != nil
+	case *hrdpReader:
+		return r.Reception(), r.stamp
+	default:
+		return time.Time{}, false
+	}
+}
+
+// warnUndelimited reports when the last packet read from r has not been
+// delimited by a synchronization word (see ErrUndelimited).
+func warnUndelimited(r io.Reader) {
+	if p, ok := r.(*hrdlReader); ok && p.Undelimited() {
+		log.Printf("last HRDL packet not followed by a synchronization word: it could be truncated")
+	}
+}
+
+// demuxHRDL writes the payload of each HRDL packet read from r in its own file
+// under dir. The files are grouped by channel and are named after the sequence
+// counter of the packets (and the UPI for images).
+func demuxHRDL(r io.Reader, dir string, keep bool, st strict) error {
+	body := make([]byte, vmu.BufferSize)
+	var total, errCRC, errMissing, errInvalid, errLength int
+	for {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if st.Fail(err) {
+				return err
+			}
+			if n, ok := erdle.IsMissingCadu(err); ok {
+				errMissing += n
+			} else if erdle.IsCRCError(err) {
+				errCRC++
+			} else if erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				errLength++
+			} else {
+				return err
+			}
+			continue
+		}
+		z := 0
+		if n >= 12 {
+			z = int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12
+		}
+		if z == 0 || z > n {
+			if err := (erdle.LengthError{Want: z, Got: n}); st.Fail(err) {
+				return err
+			}
+			errLength++
+			continue
+		}
+		if s := vmu.Sum(body[8 : z-4]); s != binary.LittleEndian.Uint32(body[z-4:]) {
+			if err := checksumError(r, binary.LittleEndian.Uint32(body[z-4:]), s); st.Fail(err) {
+				return err
+			}
+			errInvalid++
+			if !keep {
+				continue
+			}
+		}
+		h, err := erdle.DecodeHRDLHeader(body[:z])
+		if err != nil {
+			errLength++
+			continue
+		}
+		if err := writePayload(dir, h, body[:z]); err != nil {
+			return err
+		}
+		total++
+	}
+	log.Printf("%d HRDL packets written, %d invalid cks, %d invalid len (%d missing cadus, %d corrupted)", total, errInvalid, errLength, errMissing, errCRC)
+	return nil
+}
+
+// writePayload writes the payload of the HRDL packet bs (with its checksum) in
+// dir. The payload of packets of unknown type starts after the data header.
+func writePayload(dir string, h erdle.HRDLHeader, bs []byte) error {
+	var (
+		file    = fmt.Sprintf("seq_%08d.bin", h.Sequence)
+		payload []byte
+		ok      bool
+	)
+	switch h.Type() {
+	case erdle.TypeScience:
+		payload, ok = erdle.SciencePayload(bs)
+	case erdle.TypeImage:
+		payload, ok = erdle.ImagePayload(bs)
+		if h.UPI != "" {
+			file = fmt.Sprintf("%s_%08d.bin", strings.Map(safeRune, h.UPI), h.Sequence)
+		}
+	}
+	if !ok {
+		offset := erdle.WordLen + erdle.HRDLSizeLen + erdle.VMUHeaderLen + erdle.DataHeaderLen
+		if offset > len(bs)-erdle.HRDLTrailerLen {
+			offset = len(bs) - erdle.HRDLTrailerLen
+		}
+		payload = bs[offset : len(bs)-erdle.HRDLTrailerLen]
+	}
+	dir = filepath.Join(dir, fmt.Sprintf("chan_%02x", h.Channel))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, file), payload, 0644)
+}
+
+func safeRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		return r
+	default:
+		return '_'
+	}
+}
+
+// checksumCadus prints for each cadu read from r the CRC found in its trailer
+// and the CRC computed from its content. It returns an error if at least one
+// of them differ.
+func checksumCadus(r io.Reader, skip int) error {
+	body := make([]byte, skip+erdle.CaduLen)
+	var total, invalid, truncated int
+	for i := 1; ; i++ {
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF {
+				// the last frame is incomplete: there is nothing to verify
+				truncated++
+				break
+			}
+			return err
+		}
+		xs := body[skip:]
+		want := binary.BigEndian.Uint16(xs[erdle.CaduTrailerIndex:])
+		got := erdle.Sum(xs[erdle.MagicLen:erdle.CaduTrailerIndex])
+		total++
+		if want != got {
+			invalid++
+		}
+		log.Printf("%8d | %8d | %04x | %04x | %s", i, binary.BigEndian.Uint32(xs[6:])>>8, want, got, checksumStatus(want == got))
+	}
+	log.Printf("%d cadus, %d mismatches, %d truncated", total, invalid, truncated)
+	if invalid > 0 {
+		return fmt.Errorf("%d checksum mismatches", invalid)
+	}
+	return nil
+}
+
+// checksumHRDL prints for each HRDL packet read from r the checksum found in
+// its trailer and the checksum computed from its content. It returns an error
+// if at least one of them differ.
+func checksumHRDL(r io.Reader) error {
+	body := make([]byte, vmu.BufferSize)
+	var total, invalid, errLength int
+	for i := 1; ; i++ {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsCRCError(err) {
+				continue
+			}
+			if erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				errLength++
+				continue
+			}
+			return err
+		}
+		total++
+		z := 0
+		if n >= 12 {
+			z = int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12
+		}
+		if z == 0 || z > n {
+			errLength++
+			log.Printf("%8d | %8d | %8s | %8s | %s", i, n, "-", "-", "length")
+			continue
+		}
+		want := binary.LittleEndian.Uint32(body[z-4:])
+		got := vmu.Sum(body[8 : z-4])
+		if want != got {
+			invalid++
+		}
+		log.Printf("%8d | %8d | %08x | %08x | %s", i, z, want, got, checksumStatus(want == got))
+	}
+	log.Printf("%d HRDL packets, %d mismatches, %d invalid len", total, invalid, errLength)
+	if invalid > 0 {
+		return fmt.Errorf("%d checksum mismatches", invalid)
+	}
+	return nil
+}
+
+func checksumStatus(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "mismatch"
+}
+
+type hrdpFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func openHRDP(file string) (io.ReadCloser, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	f := hrdpFile{
+		Reader:  bufio.NewReader(r),
+		closers: []io.Closer{r},
+	}
+	if strings.HasSuffix(file, ".gz") {
+		z, err := gzip.NewReader(f.Reader)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		f.Reader, f.closers = z, append([]io.Closer{z}, f.closers...)
+	}
+	return &f, nil
+}
+
+func (f *hrdpFile) Close() error {
+	var err error
+	for _, c := range f.closers {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// maxRecordLen is the size above which the length of a record is considered
+// as corrupted instead of trying to allocate a buffer for it.
+const maxRecordLen = 64 << 20
+
+// readHRDP reads one record written by hrdp.Write and gives back the HRDL
+// packet (starting with the synchronization word) stored in it.
+func readHRDP(r io.Reader) ([]byte, error) {
+	bs, err := readRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	return bs[14:], nil
+}
+
+// readRecord reads one record written by hrdp.Write and gives it back without
+// its length.
+func readRecord(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 14 {
+		return nil, erdle.LengthError{Want: 14, Got: int(size)}
+	}
+	if size > maxRecordLen {
+		return nil, erdle.LengthError{Want: maxRecordLen, Got: int(size)}
+	}
+	bs := make([]byte, size)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bs, nil
+}
+
+// hrdpReader gives the HRDL packets stored in the records of HRDP files, one
+// packet per Read. If stamp is true, the reception time written in the record
+// of the last packet read is given by Reception.
+type hrdpReader struct {
+	files []string
+	inner io.ReadCloser
+	stamp bool
+	last  time.Time
+}
+
+func (r *hrdpReader) Read(bs []byte) (int, error) {
+	for {
+		if r.inner == nil {
+			if len(r.files) == 0 {
+				return 0, io.EOF
+			}
+			f, err := openHRDP(r.files[0])
+			if err != nil {
+				return 0, err
+			}
+			r.inner, r.files = f, r.files[1:]
+		}
+		xs, err := readRecord(r.inner)
+		if err == io.EOF {
+			r.inner.Close()
+			r.inner = nil
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.last = timutil.Join5(binary.BigEndian.Uint32(xs[9:]), xs[13])
+		if xs = xs[14:]; len(xs) > len(bs) {
+			return 0, erdle.LengthError{Want: len(xs), Got: len(bs)}
+		}
+		return copy(bs, xs), nil
+	}
+}
+
+// Reception gives the reception time of the last packet read.
+func (r *hrdpReader) Reception() time.Time {
+	return r.last
+}
+
+func (r *hrdpReader) Close() error {
+	if r.inner == nil {
+		return nil
+	}
+	return r.inner.Close()
+}
+
+func verifyHRDP(files []string, st strict) error {
+	var (
+		count     int
+		size      int
+		errLength int
+		errSum    int
+		missing   uint32
+	)
+	ps := make(map[byte]uint32)
+	for _, f := range files {
+		r, err := openHRDP(f)
+		if err != nil {
+			return err
+		}
+		for {
+			bs, err := readHRDP(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if err == io.ErrUnexpectedEOF || erdle.IsLengthError(err) {
+					if st.Fail(err) {
+						r.Close()
+						return err
+					}
+					errLength++
+					break
+				}
+				r.Close()
+				return err
+			}
+			count++
+			size += len(bs)
+
+			z := 0
+			if len(bs) >= 12 {
+				z = int(binary.LittleEndian.Uint32(bs[erdle.WordLen:])) + 12
+			}
+			if z == 0 || z != len(bs) {
+				if err := (erdle.LengthError{Want: z, Got: len(bs)}); st.Fail(err) {
+					r.Close()
+					return err
+				}
+				errLength++
+				continue
+			}
+			if s := vmu.Sum(bs[8 : z-4]); s != binary.LittleEndian.Uint32(bs[z-4:]) {
+				if err := (erdle.ChecksumError{Want: binary.LittleEndian.Uint32(bs[z-4:]), Got: s}); st.Fail(err) {
+					r.Close()
+					return err
+				}
+				errSum++
+			}
+			h, err := erdle.DecodeHRDLHeader(bs)
+			if err != nil {
+				errLength++
+				continue
+			}
+			if prev, ok := ps[h.Channel]; ok {
+				// a sequence going backward (reset or reordered packet) is not a gap
+				if diff := h.Sequence - prev; diff > 1 && diff < h.Sequence {
+					missing += diff - 1
+				}
+			}
+			ps[h.Channel] = h.Sequence
+		}
+		r.Close()
+	}
+	const row = "%6d packets, %6dKB, %4d valid, %4d length error, %4d checksum error, %6d missing"
+	log.Printf(row, count, size>>10, count-errLength-errSum, errLength, errSum, missing)
+	if errLength > 0 || errSum > 0 {
+		return fmt.Errorf("%d corrupted packets", errLength+errSum)
 	}
-	log.Printf("%d HRDL packets, %d invalid cks, %d invalid len (%d KB, %d missing cadus, %d corrupted)", total, errInvalid, errLength, size>>10, errMissing, errCRC)
 	return nil
 }
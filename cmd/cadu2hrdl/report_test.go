@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+// buildRecord creates a record as written by hrdp.Write: its length, a header of
+// 14 bytes and the given data.
+func buildRecord(data []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(14+len(data)))
+	buf.Write(make([]byte, 14))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestReadRecordLarge(t *testing.T) {
+	data := bytes.Repeat([]byte{0x11}, 9<<20)
+	bs, err := readRecord(bytes.NewReader(buildRecord(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bs) != 14+len(data) || !bytes.Equal(bs[14:], data) {
+		t.Fatalf("unexpected record: %d bytes", len(bs))
+	}
+}
+
+func TestReadRecordTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(maxRecordLen+1))
+
+	_, err := readRecord(&buf)
+	if e, ok := err.(erdle.LengthError); !ok || e.Want != maxRecordLen || e.Got != maxRecordLen+1 {
+		t.Fatalf("expected LengthError, got %v", err)
+	}
+}
+
+func TestChecksumCadusTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(erdletest.BuildCadu(1, 1, nil))
+	buf.Write(erdletest.BuildCadu(2, 1, nil))
+	buf.Write(erdletest.BuildCadu(3, 1, nil)[:erdle.CaduLen/2])
+
+	if err := checksumCadus(&buf, 0); err != nil {
+		t.Fatalf("unexpected error with a truncated last cadu: %v", err)
+	}
+}
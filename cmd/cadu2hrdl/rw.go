@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"io"
+	"log"
+	"sync/atomic"
+	"time"
 
 	"github.com/busoc/erdle"
+	"github.com/midbel/ringbuffer"
 )
 
 const (
@@ -17,74 +23,572 @@ const (
 	CaduCounterMask  = 0xFFFFFF
 )
 
+// packet is a reassembled HRDL packet (or a cadu) with the counters of the
+// first and last cadus that contributed to it.
+type packet struct {
+	Data  []byte
+	First uint32
+	Last  uint32
+}
+
+// caduCounter gives the bodies of the cadus read from a VCDUReader and keeps
+// track of the counters of the cadus read since the last call to Start.
+type caduCounter struct {
+	inner io.Reader
+	frame []byte
+	skip  int
+
+	curr   uint32
+	first  uint32
+	mark   bool
+	frames int64
+	// err is the error given with the last cadu read.
+	err error
+}
+
+func newCaduCounter(r io.Reader, skip int) *caduCounter {
+	return &caduCounter{
+		inner: erdle.VCDUReader(r, skip),
+		frame: make([]byte, erdle.CaduLen),
+		skip:  skip,
+	}
+}
+
+// Start marks the beginning of a new packet. If pending is true, the packet
+// starts in the last cadu read, otherwise it starts in the next one.
+func (c *caduCounter) Start(pending bool) {
+	if pending {
+		c.first = c.curr
+	} else {
+		c.mark = true
+	}
+}
+
+func (c *caduCounter) Range() (uint32, uint32) {
+	return c.first, c.curr
+}
+
+// Offset gives the offset in the stream read (skipped bytes and cadu headers
+// included) of the byte of the bodies of the cadus that is back bytes before
+// the end of the body of the last cadu read.
+func (c *caduCounter) Offset(back int) int64 {
+	p := c.frames*CaduBodyLen - int64(back)
+	if p < 0 {
+		return 0
+	}
+	return p/CaduBodyLen*int64(c.skip+CaduLen) + int64(c.skip+CaduHeaderLen) + p%CaduBodyLen
+}
+
+// Err gives the error reported with the last cadu read (eg the missing cadus
+// that interrupted a packet given with ErrTrailerMissing).
+func (c *caduCounter) Err() error {
+	return c.err
+}
+
+func (c *caduCounter) Read(bs []byte) (int, error) {
+	n, err := c.inner.Read(c.frame)
+	c.err = err
+	if n < CaduLen {
+		return 0, err
+	}
+	c.frames++
+	c.curr = binary.BigEndian.Uint32(c.frame[6:]) >> 8
+	if c.mark {
+		c.first, c.mark = c.curr, false
+	}
+	return copy(bs, c.frame[CaduHeaderLen:CaduTrailerIndex]), err
+}
+
+// bufferSource copies r in a ring buffer of b bytes in its own goroutine so that
+// bursts of the network feed do not have to wait for the reassembler. The bytes
+// that do not fit in the ring are counted in overflow. If b is not positive, r
+// is returned as is.
+func bufferSource(r io.Reader, b int, overflow *int64) io.Reader {
+	if b <= 0 {
+		return r
+	}
+	rg := ringbuffer.NewRingSize(b, 0)
+	go func() {
+		io.CopyBuffer(&ringWriter{Writer: rg, overflow: overflow}, r, make([]byte, erdle.CaduLen))
+	}()
+	return rg
+}
+
+// ringWriter counts the bytes that the ring buffer could not accept instead of
+// reporting a short write that would stop the copy from the socket.
+type ringWriter struct {
+	io.Writer
+	overflow *int64
+}
+
+func (w *ringWriter) Write(bs []byte) (int, error) {
+	n, err := w.Writer.Write(bs)
+	if n < len(bs) || err != nil {
+		atomic.AddInt64(w.overflow, int64(len(bs)-n))
+	}
+	return len(bs), nil
+}
+
 type hrdlReader struct {
+	inner *caduCounter
+	rest  []byte
+
+	// packet grows to hold the largest packet reassembled up to limit bytes.
+	packet []byte
+	limit  int
+	// header holds the headers of the last packet given by ReadHeader.
+	header [maxHeaderLen]byte
+	// undelimited is set when the last packet read has not been followed by a
+	// synchronization word (see ErrUndelimited).
+	undelimited bool
+	// debug is set to dump the packets that can not be decoded (see SetDebug).
+	debug bool
+
+	count int64
+	size  int64
+
+	// stamps is only set when the reception time of the packets is tracked.
+	stamps *stampReader
+}
+
+// DefaultPacketLimit is the default size above which HRDL packets are
+// rejected instead of being reassembled.
+const DefaultPacketLimit = 64 << 20
+
+func HRDLReader(r io.Reader, skip int) *hrdlReader {
+	return &hrdlReader{
+		inner: newCaduCounter(r, skip),
+		limit: DefaultPacketLimit,
+	}
+}
+
+// HRDFEReader is like HRDLReader for HRDFE files. Instead of being skipped, the
+// header written before each cadu is decoded to give the reception time of the
+// packets (see Reception).
+func HRDFEReader(r io.Reader) *hrdlReader {
+	s := stampReader{
+		inner: r,
+		frame: make([]byte, erdle.HRDFEHeaderLen+erdle.CaduLen),
+	}
+	return &hrdlReader{
+		inner:  newCaduCounter(&s, erdle.HRDFEHeaderLen),
+		limit:  DefaultPacketLimit,
+		stamps: &s,
+	}
+}
+
+// SetLimit changes the size (as declared in their header) above which packets
+// are rejected with a LengthError. A limit that is not positive restores
+// DefaultPacketLimit.
+func (r *hrdlReader) SetLimit(n int) {
+	if n <= 0 {
+		n = DefaultPacketLimit
+	}
+	r.limit = n
+}
+
+// SetDebug enables (or disables) the dump on stderr of the first bytes of the
+// packets whose length does not match their declared size, with the offset in
+// the stream read where their size has been read.
+func (r *hrdlReader) SetDebug(debug bool) {
+	r.debug = debug
+}
+
+// debugPacket dumps the first bytes of buffer (a stuffed packet starting with
+// its synchronization word) when the debug mode is enabled. The size of the
+// packet is back bytes before the end of the bytes read.
+func (r *hrdlReader) debugPacket(buffer []byte, back int, err error) {
+	if !r.debug {
+		return
+	}
+	if len(buffer) > 64 {
+		buffer = buffer[:64]
+	}
+	log.Printf("debug: %s (size read at offset %d)\n%s", err, r.inner.Offset(back), hex.Dump(buffer))
+}
+
+// Cadus gives the counters of the first and of the last cadus of the last
+// packet read.
+func (r *hrdlReader) Cadus() (uint32, uint32) {
+	return r.inner.Range()
+}
+
+// Undelimited reports whether the last packet read has been completed because
+// its length matches its declared size instead of being delimited by the next
+// synchronization word: its end may have been truncated.
+func (r *hrdlReader) Undelimited() bool {
+	return r.undelimited
+}
+
+// Reception gives the reception time of the cadu that completed the last
+// packet read. It is zero if the reception time is not tracked.
+func (r *hrdlReader) Reception() time.Time {
+	if r.stamps == nil {
+		return time.Time{}
+	}
+	return r.stamps.last
+}
+
+// stampReader gives the frames (HRDFE header and cadu) read from inner as they
+// are and keeps the reception time of the last one.
+type stampReader struct {
 	inner io.Reader
+	frame []byte
 	rest  []byte
+	last  time.Time
+}
+
+func (s *stampReader) Read(bs []byte) (int, error) {
+	if len(s.rest) == 0 {
+		if _, err := io.ReadFull(s.inner, s.frame); err != nil {
+			return 0, err
+		}
+		if w, err := erdle.DecodeHRDFEHeader(s.frame); err == nil {
+			s.last = w
+		}
+		s.rest = s.frame
+	}
+	n := copy(bs, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
 }
 
-func HRDLReader(r io.Reader, skip int) io.Reader {
-	return &hrdlReader{inner: erdle.CaduReader(r, skip)}
+// Count gives the number of HRDL packets reassembled since the creation of the
+// reader. It can be called while another goroutine reads from r.
+func (r *hrdlReader) Count() int {
+	return int(atomic.LoadInt64(&r.count))
 }
 
+// Size gives the number of bytes of the HRDL packets reassembled since the
+// creation of the reader. It can be called while another goroutine reads from
+// r.
+func (r *hrdlReader) Size() int {
+	return int(atomic.LoadInt64(&r.size))
+}
+
+// Read copies the next packet in bs. Unlike ReadPacket, it returns a
+// LengthError if the packet does not fit in bs.
 func (r *hrdlReader) Read(bs []byte) (int, error) {
-	buffer, rest, err := nextPacket(r.inner, r.rest)
+	xs, err := r.ReadPacket()
+	if err != nil && err != ErrTrailerMissing {
+		return 0, err
+	}
+	if len(xs) > len(bs) {
+		return 0, erdle.LengthError{Want: len(xs), Got: len(bs)}
+	}
+	return copy(bs, xs), err
+}
+
+// ReadPacket gives the next packet reassembled. The returned slice is only
+// valid until the next call to ReadPacket or Read.
+func (r *hrdlReader) ReadPacket() ([]byte, error) {
+	r.inner.Start(len(r.rest) > 0)
+	buffer, rest, err := nextPacket(r.inner, r.rest, r.limit)
 	r.rest = r.rest[:0]
-	switch err {
-	case nil:
+	r.undelimited = err == ErrUndelimited
+	switch {
+	case err == nil || err == ErrUndelimited:
 		r.rest = rest
 
-		return erdle.UnstuffBytes(buffer, bs), err
-	case ErrSkip:
-		return r.Read(bs)
+		if len(buffer) > len(r.packet) {
+			r.packet = make([]byte, len(buffer))
+		}
+		n := erdle.UnstuffBytes(buffer, r.packet)
+		if z := int(binary.LittleEndian.Uint32(buffer[erdle.WordLen:])) + 12; z != n {
+			r.debugPacket(buffer, len(rest)+len(buffer)-erdle.WordLen, erdle.LengthError{Want: z, Got: n})
+		}
+		atomic.AddInt64(&r.count, 1)
+		atomic.AddInt64(&r.size, int64(n))
+		return r.packet[:n], nil
+	case err == ErrTrailerMissing:
+		n := r.completePacket(buffer)
+		atomic.AddInt64(&r.count, 1)
+		atomic.AddInt64(&r.size, int64(n))
+		return r.packet[:n], err
+	case erdle.IsLengthError(err):
+		// resync on the synchronization word following the rejected one
+		r.rest = rest
+		if r.debug {
+			// rest starts with the size of the rejected packet
+			r.debugPacket(append(append([]byte{}, erdle.Word...), rest...), len(rest), err)
+		}
+		return nil, err
 	default:
+		return nil, err
+	}
+}
+
+// completePacket unstuffs in packet the packet buffer that is only missing its
+// checksum (see ErrTrailerMissing) and sets its checksum to zero. It gives the
+// length of the packet as declared by its size.
+func (r *hrdlReader) completePacket(buffer []byte) int {
+	z := int(binary.LittleEndian.Uint32(buffer[erdle.WordLen:])) + 12
+	if z > len(r.packet) {
+		r.packet = make([]byte, z)
+	}
+	n := copy(r.packet, buffer[:erdle.WordLen+erdle.HRDLSizeLen])
+	n += copy(r.packet[n:z], bytes.ReplaceAll(buffer[n:], erdle.Stuff, erdle.Stuff[:3]))
+	for i := z - erdle.HRDLTrailerLen; i < z; i++ {
+		r.packet[i] = 0
+	}
+	return z
+}
+
+// maxHeaderLen is the length of the longest headers of a HRDL packet (an image
+// packet) including the synchronization word and the size.
+const maxHeaderLen = erdle.WordLen + erdle.HRDLSizeLen + erdle.VMUHeaderLen + erdle.DataHeaderLen + erdle.ImageHeaderLen
+
+// ReadHeader decodes the headers of the next packet and gives its length
+// (synchronization word, size and trailer included). Unlike ReadPacket, the
+// packet is not unstuffed nor copied: only its headers are.
+func (r *hrdlReader) ReadHeader() (erdle.HRDLHeader, int, error) {
+	bs, z, err := r.readHeader()
+	if err != nil {
+		return erdle.HRDLHeader{}, 0, err
+	}
+	h, err := erdle.DecodeHRDLHeader(bs)
+	return h, z, err
+}
+
+func (r *hrdlReader) readHeader() ([]byte, int, error) {
+	r.inner.Start(len(r.rest) > 0)
+	buffer, rest, err := nextPacket(r.inner, r.rest, r.limit)
+	r.rest = r.rest[:0]
+	r.undelimited = err == ErrUndelimited
+	switch {
+	case err == nil || err == ErrUndelimited:
+		r.rest = rest
+
+		n := erdle.UnstuffLen(buffer)
+		if z := int(binary.LittleEndian.Uint32(buffer[erdle.WordLen:])) + 12; z != n {
+			r.debugPacket(buffer, len(rest)+len(buffer)-erdle.WordLen, erdle.LengthError{Want: z, Got: n})
+		}
+		atomic.AddInt64(&r.count, 1)
+		atomic.AddInt64(&r.size, int64(n))
+		return r.header[:erdle.UnstuffBytes(buffer, r.header[:])], n, nil
+	case err == ErrTrailerMissing:
+		n := r.completePacket(buffer)
+		atomic.AddInt64(&r.count, 1)
+		atomic.AddInt64(&r.size, int64(n))
+		return r.header[:copy(r.header[:], r.packet[:n])], n, err
+	case erdle.IsLengthError(err):
+		r.rest = rest
+		if r.debug {
+			// rest starts with the size of the rejected packet
+			r.debugPacket(append(append([]byte{}, erdle.Word...), rest...), len(rest), err)
+		}
+		return nil, 0, err
+	default:
+		return nil, 0, err
+	}
+}
+
+// readHeaders is like readPacket but, if r gives HRDL packets, only the headers
+// of the packet are copied in body. It gives the number of bytes copied and the
+// length of the packet.
+func readHeaders(r io.Reader, body []byte) (int, int, error) {
+	p, ok := r.(*hrdlReader)
+	if !ok {
+		n, err := r.Read(body)
+		return n, n, err
+	}
+	xs, z, err := p.readHeader()
+	if err != nil && err != ErrTrailerMissing {
+		return 0, 0, err
+	}
+	return copy(body, xs), z, err
+}
+
+// readPacket reads the next packet from r in body. If r gives HRDL packets
+// (see HRDLReader), body grows to hold the packet.
+func readPacket(r io.Reader, body *[]byte) (int, error) {
+	p, ok := r.(*hrdlReader)
+	if !ok {
+		return r.Read(*body)
+	}
+	xs, err := p.ReadPacket()
+	if err != nil && err != ErrTrailerMissing {
 		return 0, err
 	}
+	if len(xs) > len(*body) {
+		*body = make([]byte, len(xs))
+	}
+	return copy(*body, xs), err
+}
+
+// readerPool bounds the number of buffered readers (and so the memory) used
+// by the connections handled concurrently. Readers are allocated on demand and
+// Get blocks once size readers are in use.
+type readerPool struct {
+	size    int
+	readers chan *bufio.Reader
+	tokens  chan struct{}
+}
+
+func newReaderPool(n, size int) *readerPool {
+	if n <= 0 {
+		n = 1
+	}
+	return &readerPool{
+		size:    size,
+		readers: make(chan *bufio.Reader, n),
+		tokens:  make(chan struct{}, n),
+	}
+}
+
+// Get gives a reader reading from r, waiting for a reader to be put back if
+// all of them are in use.
+func (p *readerPool) Get(r io.Reader) *bufio.Reader {
+	p.tokens <- struct{}{}
+	select {
+	case rs := <-p.readers:
+		rs.Reset(r)
+		return rs
+	default:
+		return bufio.NewReaderSize(r, p.size)
+	}
+}
+
+// Put gives back rs to the pool. The data still buffered in rs are discarded.
+func (p *readerPool) Put(rs *bufio.Reader) {
+	rs.Reset(nil)
+	p.readers <- rs
+	<-p.tokens
+}
+
+type rawOptions struct {
+	Prefix      bool
+	KeepHeader  bool
+	KeepTrailer bool
+}
+
+// rawHRDL copies the HRDL packets read from r to w. Packets that can not be
+// fully reassembled (missing or corrupted cadus) are discarded.
+//
+// Without KeepHeader, the sync word and the size are removed from the packets
+// and without KeepTrailer, the checksum is removed. The length written before
+// each packet (if Prefix is set) is the length of the bytes actually written.
+func rawHRDL(r io.Reader, w io.Writer, opts rawOptions) error {
+	var first, last int
+	if !opts.KeepHeader {
+		first = erdle.WordLen + erdle.HRDLSizeLen
+	}
+	if !opts.KeepTrailer {
+		last = erdle.HRDLTrailerLen
+	}
+	ws := bufio.NewWriterSize(w, 1<<20)
+	body := make([]byte, 8<<20)
+	for {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsCRCError(err) || erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				continue
+			}
+			return err
+		}
+		if n < erdle.WordLen+erdle.HRDLSizeLen {
+			continue
+		}
+		z := int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12
+		if z > n {
+			continue
+		}
+		xs := body[first : z-last]
+		if opts.Prefix {
+			binary.Write(ws, binary.LittleEndian, uint32(len(xs)))
+		}
+		if _, err := ws.Write(xs); err != nil {
+			return err
+		}
+	}
+	return ws.Flush()
 }
 
-func nextPacket(r io.Reader, rest []byte) ([]byte, []byte, error) {
+// minPacketLen is the length of the shortest HRDL packet: a VMU header without
+// data between the size and the checksum.
+const minPacketLen = erdle.WordLen + erdle.HRDLSizeLen + erdle.VMUHeaderLen + erdle.HRDLTrailerLen
+
+// nextPacket gives the next packet (still stuffed) read from r, starting with
+// the bytes left by the previous call. Packets larger than limit or shorter
+// than minPacketLen (as declared in their header) are rejected with a
+// LengthError as soon as their size is read: the returned bytes follow the
+// synchronization word of the rejected packet so that the next call resyncs on
+// the next word.
+//
+// When r fails before the next synchronization word, the packet is given with
+// ErrUndelimited if it has at least the length declared by its size or with
+// ErrTrailerMissing if only its checksum is missing.
+func nextPacket(r io.Reader, rest []byte, limit int) ([]byte, []byte, error) {
 	buffer := make([]byte, 0, 256<<10)
 	if len(rest) > 0 {
 		buffer = append(buffer, rest...)
 	}
 	block := make([]byte, CaduBodyLen)
 
-	var offset int
-	for {
+	// the bytes left by the previous call are searched before reading r so
+	// that the cadus read are only the ones that carry the packet.
+	for kept := -1; ; {
+		if ix := bytes.Index(buffer, erdle.Word); ix >= 0 {
+			if c, ok := r.(*caduCounter); ok && kept >= 0 && ix >= kept {
+				// the cadus read before the last one have been discarded
+				c.Start(true)
+			}
+			buffer = buffer[ix:]
+			break
+		}
+		// only keep the bytes that could be the beginning of the word
+		if n := len(buffer) - erdle.WordLen + 1; n > 0 {
+			buffer = append(buffer[:0], buffer[n:]...)
+		}
+		kept = len(buffer)
 		n, err := r.Read(block)
 		if err != nil {
 			return nil, nil, err
 		}
 		buffer = append(buffer, block[:n]...)
-		if bytes.Equal(buffer[:erdle.WordLen], erdle.Word) {
+	}
+	offset := erdle.WordLen
+	for checked := false; ; {
+		if !checked && len(buffer) >= erdle.WordLen+erdle.HRDLSizeLen {
+			z := int(binary.LittleEndian.Uint32(buffer[erdle.WordLen:])) + 12
+			if z > limit {
+				return nil, buffer[erdle.WordLen:], erdle.LengthError{Want: limit, Got: z}
+			}
+			if z < minPacketLen {
+				// a desync could give a word followed by a null size
+				return nil, buffer[erdle.WordLen:], erdle.LengthError{Want: minPacketLen, Got: z}
+			}
+			checked = true
+		}
+		if ix := bytes.Index(buffer[offset:], erdle.Word); ix >= 0 {
+			buffer, rest = buffer[:offset+ix], buffer[offset+ix:]
 			break
 		}
-		if len(buffer[offset:]) > erdle.WordLen {
-			if ix := bytes.Index(buffer[offset:], erdle.Word); ix >= 0 {
-				buffer = buffer[offset+ix:]
-				break
-			}
+		if n := len(buffer) - erdle.WordLen + 1; n > offset {
+			offset = n
 		}
-		offset += n - erdle.WordLen
-	}
-	offset = erdle.WordLen
-	for {
 		n, err := r.Read(block)
 		if err != nil {
 			// verify the length of the buffer
 			// we've maybe a full HRDL packet and the loss of cadu happens when, at least, one filler has been received
 			// if we've enough bytes, we know that we've a full "valid" HRDL packet
-			if z := binary.LittleEndian.Uint32(buffer[erdle.WordLen:]) + 12; len(buffer) >= int(z) {
-				return buffer, nil, nil
-			} else {
+			if !checked {
 				return nil, nil, err
 			}
+			z := int(binary.LittleEndian.Uint32(buffer[erdle.WordLen:])) + 12
+			if len(buffer) >= z {
+				return buffer, nil, ErrUndelimited
+			}
+			// each stuff marker is one byte longer than the bytes it replaces
+			if n := len(buffer) - bytes.Count(buffer[erdle.WordLen+erdle.HRDLSizeLen:], erdle.Stuff); n >= z-erdle.HRDLTrailerLen {
+				return buffer, nil, ErrTrailerMissing
+			}
+			return nil, nil, err
 		}
 		buffer = append(buffer, block[:n]...)
-		if ix := bytes.Index(buffer[offset:], erdle.Word); ix >= 0 {
-			buffer, rest = buffer[:offset+ix], buffer[offset+ix:]
-			break
-		}
-		offset += n - erdle.WordLen
 	}
 	return buffer, rest, nil
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+// buildCadus splits bs in the bodies of successive cadus of the virtual channel
+// 1, starting at counter first. The last body is padded with zeros.
+func buildCadus(first uint32, bs []byte) [][]byte {
+	var cs [][]byte
+	for len(bs) > 0 {
+		n := CaduBodyLen
+		if n > len(bs) {
+			n = len(bs)
+		}
+		cs = append(cs, erdletest.BuildCadu(first, 1, bs[:n]))
+		bs, first = bs[n:], first+1
+	}
+	return cs
+}
+
+// buildPacket creates a HRDL packet of channel c with a payload of n bytes.
+func buildPacket(c uint8, seq uint32, n int) []byte {
+	h := erdle.HRDLHeader{Channel: c, Sequence: seq}
+	return erdletest.BuildHRDL(h, bytes.Repeat([]byte{0x11}, n))
+}
+
+// truncatedStream gives a stream where the cadu carrying the checksum of a
+// first packet is missing, followed by a second packet.
+func truncatedStream(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	// 52 bytes of headers and checksum: the first cadu holds all but the checksum
+	first := buildPacket(1, 1, CaduBodyLen-48)
+	if len(first) != CaduBodyLen+erdle.HRDLTrailerLen {
+		t.Fatalf("unexpected packet length: %d", len(first))
+	}
+	second := buildPacket(1, 2, 64)
+
+	var buf bytes.Buffer
+	cs := buildCadus(1, first)
+	buf.Write(cs[0])
+	// cs[1] (the checksum) is lost and the cadu reporting the gap is filler
+	buf.Write(erdletest.BuildCadu(3, 1, nil))
+	for _, c := range buildCadus(4, second) {
+		buf.Write(c)
+	}
+	return buf.Bytes(), second
+}
+
+func TestReadPacketTrailerMissing(t *testing.T) {
+	stream, second := truncatedStream(t)
+	r := HRDLReader(bytes.NewReader(stream), 0)
+
+	bs, err := r.ReadPacket()
+	if err != ErrTrailerMissing {
+		t.Fatalf("expected ErrTrailerMissing, got %v", err)
+	}
+	if want := CaduBodyLen + erdle.HRDLTrailerLen; len(bs) != want {
+		t.Fatalf("truncated packet: want %d bytes, got %d", want, len(bs))
+	}
+	if h, err := erdle.DecodeHRDLHeader(bs); err != nil || h.Sequence != 1 {
+		t.Fatalf("truncated packet: unexpected header (%+v, %v)", h, err)
+	}
+	bs, err = r.ReadPacket()
+	if err != nil {
+		t.Fatalf("unexpected error after truncated packet: %v", err)
+	}
+	// the last packet is not delimited: it is given with the padding of its cadu
+	if n, want := erdle.Unstuff(second); !bytes.HasPrefix(bs, want[:n]) {
+		t.Fatalf("packet following the truncated one not recovered")
+	}
+}
+
+func TestReassembleTrailerMissing(t *testing.T) {
+	stream, second := truncatedStream(t)
+	c := ioutil.NopCloser(bytes.NewReader(stream))
+
+	q, st := reassemble(c, 8, 0, 0, 0, dropNewest, NewLogger("test", "none"))
+	var ps [][]byte
+	for p := range q {
+		ps = append(ps, p.Data)
+	}
+	if len(ps) != 1 || !bytes.HasPrefix(ps[0], second) {
+		t.Fatalf("expected only the packet following the gap, got %d packets", len(ps))
+	}
+	z := st.Snapshot()
+	if z.Missing == 0 {
+		t.Errorf("missing cadus not counted")
+	}
+	if z.Skipped != 1 || z.Discarded == 0 {
+		t.Errorf("truncated packet not counted: %d skipped, %d bytes discarded", z.Skipped, z.Discarded)
+	}
+}
+
+func imageStream(size int) ([]byte, []byte) {
+	h := erdle.HRDLHeader{Channel: 2, Sequence: 1, Property: erdle.TypeImage << 4, UPI: "IMAGE"}
+	pk := erdletest.BuildHRDL(h, bytes.Repeat([]byte{0x11}, size))
+	return bytes.Join(buildCadus(1, pk), nil), pk
+}
+
+func TestReadPacketLargeImage(t *testing.T) {
+	stream, pk := imageStream(12 << 20)
+	r := HRDLReader(bytes.NewReader(stream), 0)
+	r.SetLimit(16 << 20)
+
+	bs, err := r.ReadPacket()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, want := erdle.Unstuff(pk); !bytes.HasPrefix(bs, want[:n]) {
+		t.Fatalf("image packet not reassembled (%d bytes)", len(bs))
+	}
+	h, err := erdle.DecodeHRDLHeader(bs)
+	if err != nil {
+		t.Fatalf("unexpected error decoding header: %v", err)
+	}
+	if h.Type() != erdle.TypeImage || h.UPI != "IMAGE" {
+		t.Fatalf("unexpected header: %+v", h)
+	}
+	if payload, ok := erdle.ImagePayload(bs[:int(h.Size)+12]); !ok || len(payload) != 12<<20 {
+		t.Fatalf("unexpected payload (%d bytes)", len(payload))
+	}
+}
+
+func TestReadPacketOverLimit(t *testing.T) {
+	stream, _ := imageStream(12 << 20)
+	r := HRDLReader(bytes.NewReader(stream), 0)
+	r.SetLimit(8 << 20)
+
+	_, err := r.ReadPacket()
+	if e, ok := err.(erdle.LengthError); !ok || e.Want != 8<<20 {
+		t.Fatalf("expected LengthError for a limit of %d, got %v", 8<<20, err)
+	}
+}
+
+func TestReadPacketRandomBytes(t *testing.T) {
+	junk := make([]byte, 64*CaduBodyLen)
+	rand.New(rand.NewSource(1)).Read(junk)
+	// a word followed by a size larger than the limit
+	copy(junk[100:], erdle.Word)
+	binary.LittleEndian.PutUint32(junk[100+erdle.WordLen:], 0xFFFFFFF0)
+
+	pk := buildPacket(3, 42, 2000)
+	stream := bytes.Join(buildCadus(1, append(junk, pk...)), nil)
+
+	r := HRDLReader(bytes.NewReader(stream), 0)
+	r.SetLimit(1 << 20)
+	var oversize bool
+	for i := 0; i < 1000; i++ {
+		bs, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if e, ok := err.(erdle.LengthError); ok && e.Want == 1<<20 {
+			oversize = true
+		}
+		if err != nil {
+			continue
+		}
+		if h, err := erdle.DecodeHRDLHeader(bs); err == nil && h.Channel == 3 && h.Sequence == 42 {
+			if !oversize {
+				t.Errorf("oversized packet not rejected")
+			}
+			return
+		}
+	}
+	t.Fatalf("packet following the random bytes not recovered")
+}
+
+func TestReadPacketUndelimited(t *testing.T) {
+	// the packet fills exactly two cadus and is not followed by a word
+	pk := buildPacket(1, 7, 2*CaduBodyLen-52)
+	if len(pk) != 2*CaduBodyLen {
+		t.Fatalf("unexpected packet length: %d", len(pk))
+	}
+	stream := bytes.Join(buildCadus(1, pk), nil)
+
+	buffer, rest, err := nextPacket(newCaduCounter(bytes.NewReader(stream), 0), nil, DefaultPacketLimit)
+	if err != ErrUndelimited {
+		t.Fatalf("expected ErrUndelimited, got %v", err)
+	}
+	if !bytes.Equal(buffer, pk) || len(rest) != 0 {
+		t.Fatalf("unexpected packet: %d bytes (%d left)", len(buffer), len(rest))
+	}
+
+	r := HRDLReader(bytes.NewReader(stream), 0)
+	bs, err := r.ReadPacket()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.Undelimited() {
+		t.Errorf("packet not reported as undelimited")
+	}
+	if n, want := erdle.Unstuff(pk); !bytes.Equal(bs, want[:n]) {
+		t.Errorf("unexpected packet: %d bytes", len(bs))
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadPacketNullSize(t *testing.T) {
+	var body []byte
+	body = append(body, erdle.Word...)
+	body = append(body, 0, 0, 0, 0)
+	body = append(body, bytes.Repeat([]byte{0x22}, 32)...)
+	pk := buildPacket(1, 9, 100)
+	body = append(body, pk...)
+
+	r := HRDLReader(bytes.NewReader(bytes.Join(buildCadus(1, body), nil)), 0)
+	_, err := r.ReadPacket()
+	if e, ok := err.(erdle.LengthError); !ok || e.Want != minPacketLen || e.Got != 12 {
+		t.Fatalf("expected LengthError (want %d, got 12), got %v", minPacketLen, err)
+	}
+	bs, err := r.ReadPacket()
+	if err != nil {
+		t.Fatalf("unexpected error after null size: %v", err)
+	}
+	if h, err := erdle.DecodeHRDLHeader(bs); err != nil || h.Sequence != 9 {
+		t.Fatalf("packet following the null size not recovered (%+v, %v)", h, err)
+	}
+}
+
+func TestNextPacketFarWord(t *testing.T) {
+	// the word is beyond the first 2048 bytes read
+	body := bytes.Repeat([]byte{0x33}, 2049)
+	pk := buildPacket(1, 5, 100)
+	body = append(append(body, pk...), erdle.Word...)
+
+	r := newCaduCounter(bytes.NewReader(bytes.Join(buildCadus(1, body), nil)), 0)
+	buffer, _, err := nextPacket(r, nil, DefaultPacketLimit)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buffer, pk) {
+		t.Fatalf("packet after 2049 bytes not found (%d bytes)", len(buffer))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexEntry is an HRDL packet listed by the index command: the number of the
+// cadu (starting at 1) where its header has been found, its channel (or its
+// origin when the index was created with -b mix) and its time.
+type indexEntry struct {
+	Cadu    int
+	Channel uint8
+	When    time.Time
+}
+
+const indexTimeLayout = "2006-01-02 15:04:05.000"
+
+// readIndex reads the entries of an index written by the index command. Lines
+// that are not packets are ignored.
+func readIndex(file string) ([]indexEntry, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var es []indexEntry
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// pid || elapsed | cadu | counter | missing || size | channel | sequence | time
+		parts := strings.Split(s.Text(), "||")
+		if len(parts) != 3 {
+			continue
+		}
+		cs, ps := strings.Split(parts[1], "|"), strings.Split(parts[2], "|")
+		if len(cs) != 4 || len(ps) != 4 {
+			continue
+		}
+		var e indexEntry
+		if e.Cadu, err = strconv.Atoi(strings.TrimSpace(cs[1])); err != nil {
+			continue
+		}
+		c, err := strconv.ParseUint(strings.TrimSpace(ps[1]), 16, 8)
+		if err != nil {
+			continue
+		}
+		e.Channel = uint8(c)
+		if e.When, err = time.Parse(indexTimeLayout, strings.TrimSpace(ps[3])); err != nil {
+			continue
+		}
+		es = append(es, e)
+	}
+	return es, s.Err()
+}
+
+// selection selects the packets of an index by channel (any channel if it is
+// negative) and by time (from and to are ignored when zero).
+type selection struct {
+	Channel int
+	From    time.Time
+	To      time.Time
+}
+
+func (s selection) Match(e indexEntry) bool {
+	if s.Channel >= 0 && int(e.Channel) != s.Channel {
+		return false
+	}
+	if !s.From.IsZero() && e.When.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && e.When.After(s.To) {
+		return false
+	}
+	return true
+}
+
+// Ranges gives the ranges of cadus (zero based, end excluded) that contain the
+// packets selected. A packet starts in the cadu before the one given by the
+// index (its header can be split over two cadus) and ends in the cadu where the
+// next packet starts (the last packet of the index ends with the file).
+// Overlapping ranges are merged.
+func (s selection) Ranges(es []indexEntry) [][2]int {
+	var rs [][2]int
+	for i, e := range es {
+		if !s.Match(e) {
+			continue
+		}
+		start, end := e.Cadu-2, math.MaxInt32
+		if start < 0 {
+			start = 0
+		}
+		if i+1 < len(es) {
+			end = es[i+1].Cadu
+		}
+		if n := len(rs); n > 0 && start <= rs[n-1][1] {
+			if end > rs[n-1][1] {
+				rs[n-1][1] = end
+			}
+			continue
+		}
+		rs = append(rs, [2]int{start, end})
+	}
+	return rs
+}
+
+// selectCadus gives the cadus of file in the ranges given by rs. Each cadu is
+// preceded by skip bytes as in file.
+func selectCadus(file string, skip int, rs [][2]int) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	i, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	z := int64(skip + CaduLen)
+	sr := make([]io.Reader, len(rs))
+	for j, r := range rs {
+		offset, size := int64(r[0])*z, int64(r[1]-r[0])*z
+		if offset+size > i.Size() {
+			size = i.Size() - offset
+		}
+		if size < 0 {
+			size = 0
+		}
+		sr[j] = io.NewSectionReader(f, offset, size)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(sr...), f}, nil
+}
+
+// parseTime parses the times given on the command line: either as RFC3339 or
+// as in the index (UTC).
+func parseTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, indexTimeLayout, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s", str)
+}
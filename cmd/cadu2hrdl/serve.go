@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/busoc/erdle"
+	"golang.org/x/net/websocket"
+)
+
+// record is the json representation of the HRDL packets sent to the clients of
+// the stream endpoint.
+type record struct {
+	Channel  uint8     `json:"channel"`
+	Source   uint8     `json:"source"`
+	Sequence uint32    `json:"sequence"`
+	When     time.Time `json:"when"`
+	Type     uint8     `json:"type"`
+	Origin   uint8     `json:"origin"`
+	Counter  uint32    `json:"counter"`
+	Acqtime  time.Time `json:"acqtime"`
+	UPI      string    `json:"upi,omitempty"`
+	Size     int       `json:"size"`
+	First    uint32    `json:"first"`
+	Last     uint32    `json:"last"`
+}
+
+// broker fans out the packets reassembled to the clients of the stream
+// endpoint. Each client has its own queue and packets are dropped for a client
+// that can not keep up so that a slow client never blocks the others.
+type broker struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	size    int
+
+	sent    int64
+	dropped int64
+}
+
+func newBroker(n int) *broker {
+	return &broker{
+		clients: make(map[chan []byte]struct{}),
+		size:    n,
+	}
+}
+
+func (b *broker) Subscribe() chan []byte {
+	q := make(chan []byte, b.size)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients[q] = struct{}{}
+	return q
+}
+
+func (b *broker) Unsubscribe(q chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, q)
+}
+
+func (b *broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+func (b *broker) Publish(bs []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for q := range b.clients {
+		select {
+		case q <- bs:
+			atomic.AddInt64(&b.sent, 1)
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+		}
+	}
+}
+
+// servePackets encodes the HRDL packets received from queue (without sync word
+// and size) as json and gives them to the clients of b.
+func servePackets(queue <-chan packet, b *broker) {
+	for p := range queue {
+		h, err := erdle.DecodeHRDLHeader(p.Data)
+		if err != nil {
+			continue
+		}
+		r := record{
+			Channel:  h.Channel,
+			Source:   h.Source,
+			Sequence: h.Sequence,
+			When:     h.When,
+			Type:     h.Type(),
+			Origin:   h.Origin,
+			Counter:  h.Counter,
+			Acqtime:  h.Acqtime,
+			UPI:      h.UPI,
+			Size:     len(p.Data) - erdle.HRDLTrailerLen,
+			First:    p.First,
+			Last:     p.Last,
+		}
+		bs, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		b.Publish(append(bs, '\n'))
+	}
+}
+
+// streamHandler writes the packets published by b as NDJSON until the client
+// goes away.
+func streamHandler(b *broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		q := b.Subscribe()
+		defer b.Unsubscribe(q)
+
+		w.Header().Set("content-type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+		for {
+			select {
+			case bs := <-q:
+				if _, err := w.Write(bs); err != nil {
+					return
+				}
+				f.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// statsHandler writes the current counters of the reassembler and of b as json.
+func statsHandler(st *Stats, b *broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := struct {
+			Stats
+			Clients int   `json:"clients"`
+			Sent    int64 `json:"sent"`
+			Dropped int64 `json:"client_dropped"`
+		}{
+			Stats:   st.Snapshot(),
+			Clients: b.Clients(),
+			Sent:    atomic.LoadInt64(&b.sent),
+			Dropped: atomic.LoadInt64(&b.dropped),
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// websocketHandler sends the messages published by b to the websocket clients
+// until they go away.
+func websocketHandler(b *broker) http.Handler {
+	return websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		q := b.Subscribe()
+		defer b.Unsubscribe(q)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var msg string
+			for {
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case bs := <-q:
+				if err := websocket.Message.Send(ws, string(bs)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	})
+}
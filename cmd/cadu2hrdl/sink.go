@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busoc/erdle"
+)
+
+// Sink is where relay writes the HRDL packets it has reassembled.
+type Sink interface {
+	io.Writer
+	// Nacks gives the number of packets rejected by the remote server(s).
+	Nacks() int64
+}
+
+// openSink creates the sink of the remote address a. nats:// addresses publish
+// the packets to a NATS server, any other address is given to NewFanout. NATS
+// is the only broker supported: kafka:// addresses are rejected instead of being
+// taken for hadock servers.
+func openSink(a string, n, i, r, q int, idle time.Duration, ack bool, cfg *tls.Config) (Sink, error) {
+	switch proto, _ := protoFromAddr(a); proto {
+	case "nats":
+		return newNATS(a)
+	case "kafka":
+		return nil, fmt.Errorf("%s: kafka is not supported", a)
+	default:
+		return NewFanout(a, n, i, r, q, idle, ack, cfg)
+	}
+}
+
+const natsPort = "4222"
+
+// natsSink publishes each HRDL packet (without sync word and size) as a message
+// on a NATS server. The subject of a message is made of the path of the url
+// (hrdl by default) followed by the channel of the packet or, with by=origin in
+// the query, by its origin: nats://localhost:4222/erdle?by=origin gives subjects
+// like erdle.41.
+//
+// As the pool, the connection is reopened on the next write after a failure.
+type natsSink struct {
+	mu      sync.Mutex
+	addr    string
+	subject string
+	origin  bool
+	user    *url.Userinfo
+
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newNATS(a string) (*natsSink, error) {
+	u, err := url.Parse(a)
+	if err != nil {
+		return nil, err
+	}
+	n := natsSink{
+		addr:    u.Host,
+		subject: strings.Trim(strings.Replace(u.Path, "/", ".", -1), "."),
+		user:    u.User,
+	}
+	if _, _, err := net.SplitHostPort(n.addr); err != nil {
+		n.addr = net.JoinHostPort(n.addr, natsPort)
+	}
+	if n.subject == "" {
+		n.subject = "hrdl"
+	}
+	switch by := strings.ToLower(u.Query().Get("by")); by {
+	case "", "channel":
+	case "origin", "source":
+		n.origin = true
+	default:
+		return nil, fmt.Errorf("unrecognized value %s", by)
+	}
+	if err := n.connect(); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// Nacks is always zero: messages are published without acknowledgement.
+func (n *natsSink) Nacks() int64 {
+	return 0
+}
+
+func (n *natsSink) Write(bs []byte) (int, error) {
+	h, err := erdle.DecodeHRDLHeader(bs)
+	if err != nil {
+		return 0, err
+	}
+	id := h.Channel
+	if n.origin {
+		id = h.Origin
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return 0, err
+		}
+	}
+	fmt.Fprintf(n.w, "PUB %s.%d %d\r\n", n.subject, id, len(bs))
+	n.w.Write(bs)
+	n.w.WriteString("\r\n")
+	if err := n.w.Flush(); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+// connect opens the connection to the server: the server first sends its INFO
+// and then expects the CONNECT of the client. It should be called with mu held.
+func (n *natsSink) connect() error {
+	c, err := net.Dial("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(c)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO") {
+		c.Close()
+		return fmt.Errorf("%s: unexpected reply from server: %s", n.addr, strings.TrimSpace(line))
+	}
+	opts := struct {
+		Verbose  bool   `json:"verbose"`
+		Pedantic bool   `json:"pedantic"`
+		Name     string `json:"name"`
+		User     string `json:"user,omitempty"`
+		Pass     string `json:"pass,omitempty"`
+	}{
+		Name: Program,
+	}
+	if n.user != nil {
+		opts.User = n.user.Username()
+		opts.Pass, _ = n.user.Password()
+	}
+	bs, err := json.Marshal(opts)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	n.conn, n.w = c, bufio.NewWriter(c)
+	fmt.Fprintf(n.w, "CONNECT %s\r\n", bs)
+	if err := n.w.Flush(); err != nil {
+		c.Close()
+		n.conn = nil
+		return err
+	}
+	go n.serve(c, r)
+	return nil
+}
+
+// serve answers the PING of the server (that otherwise closes the connection)
+// and logs the errors it sends.
+func (n *natsSink) serve(c net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			n.mu.Lock()
+			if n.conn == c {
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("%s: %s", n.addr, line)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == c {
+		c.Close()
+		n.conn = nil
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// readBufferSize gives the size of the read buffer of c as reported by the
+// kernel. Linux doubles the value requested (for its own bookkeeping) and
+// clamps it to net.core.rmem_max.
+func readBufferSize(c *net.UDPConn) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		size int
+		serr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err == nil {
+		err = serr
+	}
+	return size, err
+}
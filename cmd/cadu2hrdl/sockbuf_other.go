@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func readBufferSize(c *net.UDPConn) (int, error) {
+	return 0, fmt.Errorf("read buffer size not available")
+}
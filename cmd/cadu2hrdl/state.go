@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/busoc/erdle"
+)
+
+// state records how far store went: the last file written, the time of the
+// last packet written and the last sequence counter of each channel (the cadu
+// counter of each virtual channel when storing cadus).
+//
+// For HRDL packets, the time of a packet is its acquisition time. Since cadus
+// do not carry a time, the time they have been written is used instead.
+type state struct {
+	mu   sync.Mutex
+	file string
+
+	Filename  string           `json:"file"`
+	Last      time.Time        `json:"last"`
+	Sequences map[uint8]uint32 `json:"sequences"`
+}
+
+// loadState reads the state saved in file. An empty state is returned if file
+// does not exist yet.
+func loadState(file string) (*state, error) {
+	s := state{
+		file:      file,
+		Sequences: make(map[uint8]uint32),
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &s, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Sequences == nil {
+		s.Sequences = make(map[uint8]uint32)
+	}
+	return &s, nil
+}
+
+// Watermark gives the time of the last packet written by the previous run.
+func (s *state) Watermark() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Last
+}
+
+func (s *state) Update(file string, bs []byte) {
+	channel, seq, when, ok := packetInfo(bs)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Filename = file
+	s.Sequences[channel] = seq
+	if when.After(s.Last) {
+		s.Last = when
+	}
+}
+
+// Flush writes the state in a temporary file that then replaces the previous
+// state so that a crash never leaves a partial state behind.
+func (s *state) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.file + ".tmp"
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// packetInfo gives the channel, the sequence counter and the time of bs that
+// can either be a cadu or an HRDL packet.
+func packetInfo(bs []byte) (uint8, uint32, time.Time, bool) {
+	if bytes.HasPrefix(bs, erdle.Magic) {
+		if len(bs) < erdle.CaduHeaderLen {
+			return 0, 0, time.Time{}, false
+		}
+		return bs[5] & 0x3F, binary.BigEndian.Uint32(bs[6:]) >> 8, time.Now(), true
+	}
+	h, err := erdle.DecodeHRDLHeader(bs)
+	if err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	return h.Channel, h.Sequence, h.When, true
+}
+
+// skipBefore drops the packets received from queue whose acquisition time is
+// not after w.
+func skipBefore(queue <-chan packet, w time.Time) <-chan packet {
+	q := make(chan packet, cap(queue))
+	go func() {
+		defer close(q)
+		for p := range queue {
+			h, err := erdle.DecodeHRDLHeader(p.Data)
+			if err == nil && !h.When.After(w) {
+				continue
+			}
+			q <- p
+		}
+	}()
+	return q
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds the counters of the reassembler. Its fields are updated
+// atomically and should be read via Snapshot while reassembling is running.
+type Stats struct {
+	Count   int64 `json:"count"`
+	Skipped int64 `json:"skipped"`
+	Dropped int64 `json:"dropped"`
+	// Evicted is the number of packets removed from the queue to make room for
+	// newer ones (with the oldest drop policy).
+	Evicted   int64 `json:"evicted"`
+	Waited    int64 `json:"waited"`
+	Missing   int64 `json:"missing"`
+	CRC       int64 `json:"crc_error"`
+	Discarded int64 `json:"discarded"`
+	// Overflow is the number of bytes that could not be written in the buffer
+	// between the socket and the reassembler.
+	Overflow int64 `json:"overflow"`
+	// Oversize is the number of packets rejected because their declared size
+	// is larger than the limit of the reassembler (or shorter than the headers
+	// of a packet).
+	Oversize int64 `json:"oversize"`
+}
+
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		Count:     atomic.LoadInt64(&s.Count),
+		Skipped:   atomic.LoadInt64(&s.Skipped),
+		Dropped:   atomic.LoadInt64(&s.Dropped),
+		Evicted:   atomic.LoadInt64(&s.Evicted),
+		Waited:    atomic.LoadInt64(&s.Waited),
+		Missing:   atomic.LoadInt64(&s.Missing),
+		CRC:       atomic.LoadInt64(&s.CRC),
+		Discarded: atomic.LoadInt64(&s.Discarded),
+		Overflow:  atomic.LoadInt64(&s.Overflow),
+		Oversize:  atomic.LoadInt64(&s.Oversize),
+	}
+}
+
+func (s Stats) Sub(o Stats) Stats {
+	return Stats{
+		Count:     s.Count - o.Count,
+		Skipped:   s.Skipped - o.Skipped,
+		Dropped:   s.Dropped - o.Dropped,
+		Evicted:   s.Evicted - o.Evicted,
+		Waited:    s.Waited - o.Waited,
+		Missing:   s.Missing - o.Missing,
+		CRC:       s.CRC - o.CRC,
+		Discarded: s.Discarded - o.Discarded,
+		Overflow:  s.Overflow - o.Overflow,
+		Oversize:  s.Oversize - o.Oversize,
+	}
+}
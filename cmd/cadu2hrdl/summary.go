@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/vmu"
+)
+
+// summary gives an overview of the cadus and of the HRDL packets of a set of
+// files.
+type summary struct {
+	Cadus   int `json:"cadus"`
+	Missing int `json:"missing"`
+	CRC     int `json:"crc_error"`
+	Fill    int `json:"fill"`
+
+	Packets  int           `json:"packets"`
+	Size     int           `json:"size"`
+	Length   int           `json:"length_error"`
+	Checksum int           `json:"checksum_error"`
+	Channels map[uint8]int `json:"channels"`
+	First    time.Time     `json:"first"`
+	Last     time.Time     `json:"last"`
+}
+
+func (s summary) String() string {
+	cs := make([]int, 0, len(s.Channels))
+	for c := range s.Channels {
+		cs = append(cs, int(c))
+	}
+	sort.Ints(cs)
+
+	str := fmt.Sprintf("cadus   : %d, missing: %d, crc error: %d, fill: %d\n", s.Cadus, s.Missing, s.CRC, s.Fill)
+	str += fmt.Sprintf("packets : %d (%dMB), length error: %d, checksum error: %d\n", s.Packets, s.Size>>20, s.Length, s.Checksum)
+	for _, c := range cs {
+		str += fmt.Sprintf("  %02x    : %d\n", c, s.Channels[uint8(c)])
+	}
+	if !s.First.IsZero() {
+		str += fmt.Sprintf("acqtime : %s - %s (%s)\n", s.First.Format(time.RFC3339), s.Last.Format(time.RFC3339), s.Last.Sub(s.First))
+	}
+	return str
+}
+
+// summarize reads r once: the cadus are given to Survey while the same bytes
+// are used to reassemble the HRDL packets.
+func summarize(r io.Reader, skip, limit int) (*summary, error) {
+	pr, pw := io.Pipe()
+
+	var survey erdle.SurveyReport
+	errc := make(chan error, 1)
+	go func() {
+		s, err := erdle.Survey(erdle.VCDUReader(io.TeeReader(r, pw), skip))
+		survey = s
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+
+	hr := HRDLReader(pr, skip)
+	hr.SetLimit(limit)
+
+	s := summary{Channels: make(map[uint8]int)}
+	err := summarizeHRDL(hr, &s)
+	// unblock Survey if the packets could not all be read.
+	pr.CloseWithError(err)
+	if e := <-errc; e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Cadus = survey.Frames
+	s.Missing = survey.Missing
+	s.CRC = survey.CRC
+	s.Fill = survey.Fill
+	return &s, nil
+}
+
+func summarizeHRDL(r io.Reader, s *summary) error {
+	body := make([]byte, vmu.BufferSize)
+	for {
+		n, err := readPacket(r, &body)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if erdle.IsLengthError(err) || err == ErrTrailerMissing {
+				s.Length++
+				continue
+			}
+			if _, ok := erdle.IsMissingCadu(err); ok || erdle.IsCRCError(err) {
+				continue
+			}
+			return err
+		}
+		if n < erdle.WordLen+erdle.HRDLSizeLen+erdle.HRDLTrailerLen {
+			s.Length++
+			continue
+		}
+		s.Packets++
+		s.Size += n - 12
+		if z := int(binary.LittleEndian.Uint32(body[erdle.WordLen:])) + 12; z != n {
+			s.Length++
+		} else if sum := vmu.Sum(body[8 : n-4]); sum != binary.LittleEndian.Uint32(body[n-4:]) {
+			s.Checksum++
+		}
+		h, err := erdle.DecodeHRDLHeader(body[:n])
+		if err != nil {
+			continue
+		}
+		s.Channels[h.Channel]++
+		if s.First.IsZero() || h.Acqtime.Before(s.First) {
+			s.First = h.Acqtime
+		}
+		if h.Acqtime.After(s.Last) {
+			s.Last = h.Acqtime
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/busoc/vmu"
+)
+
+var errRotated = errors.New("rotated")
+
+// tailHRDP prints the HRDL packets appended to the most recent HRDP file found
+// under dir. When a more recent file appears (because the writer has rolled
+// its file), the current file is read until its end and the new one is opened.
+func tailHRDP(dir string, every time.Duration, raw bool) error {
+	file, err := latestHRDP(dir)
+	if err != nil {
+		return err
+	}
+	d := vmu.Dump(os.Stdout, false)
+	for {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		log.Printf("following %s", file)
+		r := follower{
+			File:  f,
+			dir:   dir,
+			every: every,
+		}
+		for {
+			bs, err := readHRDP(&r)
+			if err != nil {
+				f.Close()
+				if err == errRotated {
+					break
+				}
+				return err
+			}
+			if err := d.Dump(bs, true, raw); err != nil && err != vmu.ErrInvalid {
+				log.Println(err)
+			}
+		}
+		file = r.next
+	}
+}
+
+// follower reads a file that is still being written. It waits for new data
+// when reaching the end of the file and returns errRotated once a newer file
+// is available under dir.
+type follower struct {
+	*os.File
+	dir   string
+	every time.Duration
+	next  string
+}
+
+func (f *follower) Read(bs []byte) (int, error) {
+	for {
+		n, err := f.File.Read(bs)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if file, err := latestHRDP(f.dir); err == nil && file != f.Name() {
+			// the writer could have written the last records of the file
+			// between our previous read and the creation of the new file.
+			if n, _ := f.File.Read(bs); n > 0 {
+				return n, nil
+			}
+			f.next = file
+			return 0, errRotated
+		}
+		time.Sleep(f.every)
+	}
+}
+
+// latestHRDP gives the most recent HRDP file under dir. The directories of the
+// archive layout (year, day of year, hour) are zero padded so that the most
+// recent one is always the last one by name.
+func latestHRDP(dir string) (string, error) {
+	for {
+		es, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+		var (
+			file string
+			sub  string
+			last time.Time
+		)
+		for _, e := range es {
+			if e.IsDir() {
+				sub = e.Name()
+				continue
+			}
+			if ok, _ := filepath.Match("rt_*.dat", e.Name()); ok && !e.ModTime().Before(last) {
+				file, last = e.Name(), e.ModTime()
+			}
+		}
+		if file != "" {
+			return filepath.Join(dir, file), nil
+		}
+		if sub == "" {
+			return "", fmt.Errorf("no HRDP files found in %s", dir)
+		}
+		dir = filepath.Join(dir, sub)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// tlsOptions holds the settings used to secure the TCP connections with TLS.
+// UDP connections are never affected by these settings.
+type tlsOptions struct {
+	Enabled  bool   `toml:"enabled"`
+	CA       string `toml:"ca"`
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	Insecure bool   `toml:"insecure"`
+}
+
+func (t *tlsOptions) Bind(fs *flag.FlagSet) {
+	fs.BoolVar(&t.Enabled, "tls", false, "use tls")
+	fs.StringVar(&t.CA, "ca", "", "certificate authority file")
+	fs.StringVar(&t.Cert, "cert", "", "certificate file")
+	fs.StringVar(&t.Key, "key", "", "key file")
+	fs.BoolVar(&t.Insecure, "insecure", false, "skip verification of server certificate")
+}
+
+// Config creates the tls.Config from the options. It gives nil when TLS is not
+// enabled.
+func (t tlsOptions) Config() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+	cfg := tls.Config{
+		InsecureSkipVerify: t.Insecure,
+	}
+	if t.Cert != "" || t.Key != "" {
+		c, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	if t.CA != "" {
+		bs, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("%s: no certificate found", t.CA)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &cfg, nil
+}
+
+func isTCP(proto string) bool {
+	return strings.HasPrefix(proto, "tcp")
+}
+
+// dial connects to addr and, if cfg is not nil and addr is a TCP address,
+// performs the TLS handshake.
+func dial(addr string, cfg *tls.Config) (net.Conn, error) {
+	proto, host := protoFromAddr(addr)
+	c, err := net.Dial(proto, host)
+	if err != nil || cfg == nil || !isTCP(proto) {
+		return c, err
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			cfg.ServerName = h
+		}
+	}
+	t := tls.Client(c, cfg)
+	if err := t.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// listen listens on addr. If cfg is not nil, the accepted connections are
+// secured with TLS.
+func listen(addr string, cfg *tls.Config) (net.Listener, error) {
+	proto, host := protoFromAddr(addr)
+	if cfg == nil {
+		return net.Listen(proto, host)
+	}
+	return tls.Listen(proto, host, cfg)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/busoc/erdle"
+)
+
+// unframeHRDP writes the HRDL packets of the HRDP files without the records
+// added by store. With kind hrdl, packets are written as they were stored. With
+// kind cadu, packets are stuffed and framed again in cadus of the virtual
+// channel vc (numbered from 0): the body of the last cadu is padded with zeros.
+// It gives the number of packets read and the number of cadus written.
+func unframeHRDP(files []string, w io.Writer, kind string, vc uint8) (int, int, error) {
+	var (
+		ws      = bufio.NewWriter(w)
+		buf     bytes.Buffer
+		count   int
+		cadus   int
+		counter uint32
+	)
+	switch kind {
+	case "", "hrdl", "cadu":
+	default:
+		return 0, 0, fmt.Errorf("unknown packet type %s", kind)
+	}
+	frame := func(bs []byte) error {
+		if _, err := ws.Write(erdle.EncodeCadu(counter, vc, bs)); err != nil {
+			return err
+		}
+		counter = (counter + 1) & erdle.CaduCounterMask
+		cadus++
+		return nil
+	}
+	for _, f := range files {
+		r, err := openHRDP(f)
+		if err != nil {
+			return count, cadus, err
+		}
+		for {
+			bs, err := readHRDP(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return count, cadus, fmt.Errorf("%s: %s", f, err)
+			}
+			count++
+			if kind != "cadu" {
+				if _, err := ws.Write(bs); err != nil {
+					r.Close()
+					return count, cadus, err
+				}
+				continue
+			}
+			buf.Write(erdle.StuffBytes(bs))
+			for buf.Len() >= erdle.CaduBodyLen {
+				if err := frame(buf.Next(erdle.CaduBodyLen)); err != nil {
+					r.Close()
+					return count, cadus, err
+				}
+			}
+		}
+		r.Close()
+	}
+	if buf.Len() > 0 {
+		if err := frame(buf.Bytes()); err != nil {
+			return count, cadus, err
+		}
+	}
+	return count, cadus, ws.Flush()
+}
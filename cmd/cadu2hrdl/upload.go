@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadOptions gives the S3 compatible bucket where the files of store are
+// uploaded once they are complete. Credentials not given are taken from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+type uploadOptions struct {
+	Endpoint string `toml:"endpoint"`
+	Bucket   string `toml:"bucket"`
+	Prefix   string `toml:"prefix"`
+	Region   string `toml:"region"`
+	Access   string `toml:"access"`
+	Secret   string `toml:"secret"`
+	Delete   bool   `toml:"delete"`
+	Queue    int    `toml:"queue"`
+}
+
+func (o uploadOptions) Enabled() bool {
+	return o.Endpoint != "" && o.Bucket != ""
+}
+
+// uploader uploads the files given to Upload in the background so that store
+// never waits for the bucket. Files are dropped (and kept on disk) when too
+// many are waiting.
+type uploader struct {
+	uploadOptions
+	datadir string
+	client  *http.Client
+
+	queue chan string
+	wg    sync.WaitGroup
+}
+
+func newUploader(dir string, opts uploadOptions) (*uploader, error) {
+	if _, err := url.Parse(opts.Endpoint); err != nil {
+		return nil, err
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Access == "" {
+		opts.Access = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if opts.Secret == "" {
+		opts.Secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = 64
+	}
+	u := uploader{
+		uploadOptions: opts,
+		datadir:       dir,
+		client:        &http.Client{},
+		queue:         make(chan string, opts.Queue),
+	}
+	u.wg.Add(1)
+	go u.run()
+	return &u, nil
+}
+
+// Upload schedules the upload of file.
+func (u *uploader) Upload(file string) {
+	select {
+	case u.queue <- file:
+	default:
+		log.Printf("upload: %s not uploaded (too many files waiting)", file)
+	}
+}
+
+// Close waits for the files scheduled to be uploaded.
+func (u *uploader) Close() error {
+	close(u.queue)
+	u.wg.Wait()
+	return nil
+}
+
+func (u *uploader) run() {
+	defer u.wg.Done()
+	for file := range u.queue {
+		i, err := os.Stat(file)
+		if err != nil || i.Size() == 0 {
+			// empty files are removed by store
+			continue
+		}
+		if err := u.put(file, i.Size()); err != nil {
+			log.Printf("upload: %s: %s", file, err)
+			continue
+		}
+		if u.Delete {
+			os.Remove(file)
+		}
+	}
+}
+
+func (u *uploader) put(file string, size int64) error {
+	key, err := filepath.Rel(u.datadir, file)
+	if err != nil {
+		key = filepath.Base(file)
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	target := strings.TrimRight(u.Endpoint, "/") + path.Join("/", u.Bucket, u.Prefix, filepath.ToSlash(key))
+	req, err := http.NewRequest(http.MethodPut, target, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	signRequest(req, u.Access, u.Secret, u.Region, time.Now())
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// signRequest signs req for S3 with the AWS signature version 4. All the
+// headers of req (and its host) are signed. The x-amz-content-sha256 header
+// should already be set.
+func signRequest(req *http.Request, access, secret, region string, when time.Time) {
+	var (
+		stamp = when.UTC().Format("20060102T150405Z")
+		day   = stamp[:8]
+		scope = day + "/" + region + "/s3/aws4_request"
+	)
+	req.Header.Set("x-amz-date", stamp)
+
+	hs := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		hs[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(hs))
+	for k := range hs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(uriEncode(req.URL.Path, false) + "\n")
+	canonical.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + hs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n")
+	canonical.WriteString(req.Header.Get("x-amz-content-sha256"))
+
+	sum := sha256.Sum256([]byte(canonical.String()))
+	str := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range []string{day, region, "s3", "aws4_request", str} {
+		key = hmacSHA256(key, s)
+	}
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x", access, scope, signed, key)
+	req.Header.Set("Authorization", auth)
+}
+
+func canonicalQuery(vs url.Values) string {
+	ks := make([]string, 0, len(vs))
+	for k := range vs {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+
+	var qs []string
+	for _, k := range ks {
+		for _, v := range vs[k] {
+			qs = append(qs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(qs, "&")
+}
+
+// uriEncode encodes str as required by the signature: only the unreserved
+// characters are kept (and the slash when slash is false).
+func uriEncode(str string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, str string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(str))
+	return h.Sum(nil)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/vmu"
+)
+
+// watcher aggregates the HRDL packets appended to the HRDP files written under
+// dir by store. It remembers the file it reads and its offset so that each scan
+// only reads the packets written since the previous one.
+type watcher struct {
+	dir    string
+	file   string
+	offset int64
+
+	last  map[byte]uint32
+	curr  map[byte]*coze
+	total map[byte]*coze
+}
+
+// watchHRDP prints, every interval, the number of packets per minute, the
+// missing and the invalid packets of each channel found in the packets written
+// since the previous scan (and since the start of the command). Only the
+// packets written after watchHRDP has been started are taken into account.
+func watchHRDP(dir string, every time.Duration) error {
+	w := watcher{
+		dir:   dir,
+		last:  make(map[byte]uint32),
+		curr:  make(map[byte]*coze),
+		total: make(map[byte]*coze),
+	}
+	file, err := latestHRDP(dir)
+	if err != nil {
+		return err
+	}
+	i, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	w.file, w.offset = file, i.Size()
+	log.Printf("watching %s", w.file)
+
+	prev := time.Now()
+	for now := range time.Tick(every) {
+		if err := w.Scan(); err != nil {
+			log.Println(err)
+		}
+		w.Report(now.Sub(prev))
+		prev = now
+	}
+	return nil
+}
+
+// Scan reads the packets written since the previous scan. When store has
+// rolled its file, the end of the previous file is read before the new one.
+func (w *watcher) Scan() error {
+	file, err := latestHRDP(w.dir)
+	if err != nil {
+		return err
+	}
+	if file != w.file {
+		if err := w.scan(); err != nil {
+			log.Println(err)
+		}
+		w.file, w.offset = file, 0
+	}
+	return w.scan()
+}
+
+func (w *watcher) scan() error {
+	f, err := os.Open(w.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for {
+		bs, err := readRecord(r)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the last record could still be written: it is read again
+				// on the next scan.
+				err = nil
+			}
+			return err
+		}
+		w.offset += int64(len(bs) + 4)
+		w.update(bs[14:])
+	}
+}
+
+func (w *watcher) update(bs []byte) {
+	h, err := erdle.DecodeHRDLHeader(bs)
+	if err != nil {
+		return
+	}
+	c, ok := w.curr[h.Channel]
+	if !ok {
+		c = &coze{}
+		w.curr[h.Channel] = c
+	}
+	c.Count++
+	c.Size += len(bs)
+	if z := int(h.Size) + 12; z != len(bs) {
+		c.Invalid++
+	} else if s := vmu.Sum(bs[8 : z-4]); s != binary.LittleEndian.Uint32(bs[z-4:]) {
+		c.Invalid++
+	}
+	if prev, ok := w.last[h.Channel]; ok {
+		if diff := h.Sequence - prev; diff > 1 {
+			c.Missing += diff - 1
+		}
+	}
+	w.last[h.Channel] = h.Sequence
+}
+
+// Report prints the statistics of the last scan (elapsed is the time since the
+// previous report) and adds them to the totals.
+func (w *watcher) Report(elapsed time.Duration) {
+	for i, c := range w.curr {
+		t, ok := w.total[i]
+		if !ok {
+			t = &coze{}
+			w.total[i] = t
+		}
+		t.Update(c)
+	}
+	cs := make([]int, 0, len(w.total))
+	for i := range w.total {
+		cs = append(cs, int(i))
+	}
+	sort.Ints(cs)
+
+	const row = "%02x: %8.1f packets/min, %6d missing (%6.2f%%), %4d invalid || %8d packets, %7d missing (%6.2f%%), %6d invalid"
+	for _, i := range cs {
+		var c coze
+		if z, ok := w.curr[byte(i)]; ok {
+			c = *z
+		}
+		t := w.total[byte(i)]
+		rate := float64(c.Count) / elapsed.Minutes()
+		log.Printf(row, i, rate, c.Missing, lossRate(c), c.Invalid, t.Count, t.Missing, lossRate(*t), t.Invalid)
+	}
+	w.curr = make(map[byte]*coze)
+}
+
+// lossRate gives the percentage of packets missing.
+func lossRate(c coze) float64 {
+	all := float64(c.Count) + float64(c.Missing)
+	if all == 0 {
+		return 0
+	}
+	return float64(c.Missing) / all * 100
+}
@@ -3,23 +3,26 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/busoc/erdle"
-	"github.com/google/gopacket"
+	"github.com/busoc/erdle/cmd/internal/capture"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"golang.org/x/sync/errgroup"
 )
 
 type Coze struct {
-	Count   int
-	Size    int
-	Gaps    int
-	Missing int
-	Elapsed time.Duration
+	Count   int           `json:"count"`
+	Size    int           `json:"size"`
+	Gaps    int           `json:"gaps"`
+	Missing int           `json:"missing"`
+	Elapsed time.Duration `json:"elapsed"`
 }
 
 const line = "%d cadus (expected: %d cadus), %d gaps (%s), %d missing (%.2f%%), %dKB"
@@ -41,6 +44,8 @@ func main() {
 	// }()
 	list := flag.Bool("l", false, "show cadus list")
 	diff := flag.Bool("g", false, "show cadus gaps")
+	asJSON := flag.Bool("json", false, "print summary as json")
+	parallel := flag.Int("p", 1, "number of files processed in parallel")
 	flag.Parse()
 
 	if *list && *diff {
@@ -48,34 +53,107 @@ func main() {
 		os.Exit(1)
 	}
 
+	// with -json, stdout only receives the summary and the listings are
+	// written to stderr.
+	var w io.Writer = os.Stdout
+	if *asJSON {
+		w = os.Stderr
+	}
+
 	var z Coze
-	for _, a := range flag.Args() {
-		h, err := pcap.OpenOffline(a)
-		if err != nil {
+	if *parallel <= 1 {
+		for _, a := range flag.Args() {
+			h, err := capture.Open(a)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err := listCadus(h, w, &z, *list, *diff); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+	} else {
+		if err := listParallel(flag.Args(), *parallel, w, &z, *list, *diff); err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			os.Exit(2)
+		}
+	}
+	var ratio float64
+	if z.Count+z.Missing > 0 {
+		ratio = float64(z.Missing) / float64(z.Count+z.Missing)
+	}
+	if *asJSON {
+		c := struct {
+			Coze
+			Expected int     `json:"expected"`
+			Ratio    float64 `json:"ratio"`
+		}{
+			Coze:     z,
+			Expected: z.Count + z.Missing,
+			Ratio:    ratio * 100,
 		}
-		if err := listCadus(h, &z, *list, *diff); err != nil {
+		if err := json.NewEncoder(os.Stdout).Encode(c); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(2)
 		}
+		return
 	}
-	ratio := float64(z.Missing) / float64(z.Count+z.Missing)
 	fmt.Fprintf(os.Stdout, line, z.Count, z.Count+z.Missing, z.Gaps, z.Elapsed, z.Missing, ratio*100, z.Size>>10)
 	fmt.Fprintln(os.Stdout)
 }
 
-func listCadus(h *pcap.Handle, c *Coze, list, gap bool) error {
+// listParallel processes the files in n workers. Each file is reported in its
+// own Coze that is merged into c when the file has been fully processed. Since
+// gaps are never detected across file boundaries, the result is the same as
+// processing the files sequentially but the listings of the different files
+// can be interleaved.
+func listParallel(files []string, n int, w io.Writer, c *Coze, list, gap bool) error {
+	var (
+		grp  errgroup.Group
+		mu   sync.Mutex
+		sema = make(chan struct{}, n)
+	)
+	for _, a := range files {
+		a := a
+		sema <- struct{}{}
+		grp.Go(func() error {
+			defer func() { <-sema }()
+			h, err := capture.Open(a)
+			if err != nil {
+				return err
+			}
+			var z Coze
+			if err := listCadus(h, w, &z, list, gap); err != nil {
+				return err
+			}
+			mu.Lock()
+			c.Update(&z)
+			mu.Unlock()
+			return nil
+		})
+	}
+	return grp.Wait()
+}
+
+type channel struct {
+	Curr uint32
+	When time.Time
+}
+
+func listCadus(h *capture.Handle, w io.Writer, c *Coze, list, gap bool) error {
 	d := struct {
 		Curr    uint32
 		When    time.Time
 		Elapsed time.Duration
 	}{}
+	// virtual channels are sequenced independently: gaps are detected by
+	// comparing the counter of a cadu with the last one seen on its channel.
+	cs := make(map[uint8]channel)
 
 	defer h.Close()
-	s := gopacket.NewPacketSource(h, h.LinkType())
 	for {
-		p, err := s.NextPacket()
+		p, err := h.NextPacket()
 		if err != nil {
 			break
 		}
@@ -93,19 +171,21 @@ func listCadus(h *pcap.Handle, c *Coze, list, gap bool) error {
 
 		var missing uint32
 
+		vc := xs[5] & 0x3F
 		curr := binary.BigEndian.Uint32(xs[6:]) >> 8
 		md := p.Metadata()
 		t := md.Timestamp.UTC()
-		if diff := (curr - d.Curr) & 0xFFFFFF; diff != curr && diff > 1 {
+
+		prev, ok := cs[vc]
+		if diff := (curr - prev.Curr) & 0xFFFFFF; ok && diff > 1 {
 			missing = diff
 			c.Missing += int(missing)
 			c.Gaps++
-			if !d.When.IsZero() {
-				c.Elapsed += t.Sub(d.When)
-			}
+			c.Elapsed += t.Sub(prev.When)
 		}
+		cs[vc] = channel{Curr: curr, When: t}
 		if !list && gap && missing > 0 {
-			fmt.Fprintf(os.Stdout, "%5d | %12s | %s | %s | %7d | %7d | %d\n", c.Gaps, d.Elapsed, d.When.Format(time.RFC3339), t.Format(time.RFC3339), d.Curr, curr, missing)
+			fmt.Fprintf(w, "%5d | %12s | %02x | %s | %s | %7d | %7d | %d\n", c.Gaps, d.Elapsed, vc, prev.When.Format(time.RFC3339), t.Format(time.RFC3339), prev.Curr, curr, missing)
 		}
 		if list && !gap {
 			sn, dn := p.NetworkLayer().NetworkFlow().Endpoints()
@@ -121,7 +201,7 @@ func listCadus(h *pcap.Handle, c *Coze, list, gap bool) error {
 			} else {
 				proto = "unknown"
 			}
-			fmt.Fprintf(os.Stdout, "%8d | %12s | %s | %s:%s | %s:%s | %s | %6d | %d\n", c.Count, d.Elapsed, t.Format(time.RFC3339), sn, sp, dn, dp, proto, len(xs), missing)
+			fmt.Fprintf(w, "%8d | %12s | %s | %s:%s | %s:%s | %s | %6d | %d\n", c.Count, d.Elapsed, t.Format(time.RFC3339), sn, sp, dn, dp, proto, len(xs), missing)
 		}
 		if !d.When.IsZero() {
 			d.Elapsed += t.Sub(d.When)
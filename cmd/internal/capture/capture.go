@@ -0,0 +1,126 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const ngMagic = 0x0a0d0d0a
+
+type source interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+type Handle struct {
+	file *os.File
+	src  source
+	ng   *pcapgo.NgReader
+
+	// the filter is compiled for each link type of the interfaces of the file
+	expr string
+	bpfs map[layers.LinkType]*pcap.BPF
+}
+
+// Open opens a capture file. The format of the file (pcap or pcapng) is
+// detected from the magic number found at the beginning of the file.
+func Open(file string) (*Handle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h := Handle{file: f}
+	if binary.LittleEndian.Uint32(magic) == ngMagic {
+		h.ng, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		h.src = h.ng
+	} else {
+		h.src, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h *Handle) Close() error {
+	return h.file.Close()
+}
+
+func (h *Handle) LinkType() layers.LinkType {
+	return h.src.LinkType()
+}
+
+// SetBPFFilter makes NextPacket only return the packets matching the given
+// BPF expression. With pcapng files, the expression is compiled for the link
+// type of the interface of each packet.
+func (h *Handle) SetBPFFilter(expr string) error {
+	h.expr, h.bpfs = expr, make(map[layers.LinkType]*pcap.BPF)
+	_, err := h.filter(h.LinkType())
+	return err
+}
+
+// filter gives the BPF compiled for the link type t.
+func (h *Handle) filter(t layers.LinkType) (*pcap.BPF, error) {
+	if bpf, ok := h.bpfs[t]; ok {
+		return bpf, nil
+	}
+	bpf, err := pcap.NewBPF(t, 1<<16, h.expr)
+	if err == nil {
+		h.bpfs[t] = bpf
+	}
+	return bpf, err
+}
+
+func (h *Handle) NextPacket() (gopacket.Packet, error) {
+	var (
+		data []byte
+		ci   gopacket.CaptureInfo
+		err  error
+	)
+	for {
+		data, ci, err = h.src.ReadPacketData()
+		if err != nil {
+			return nil, err
+		}
+		if h.bpfs == nil {
+			break
+		}
+		bpf, err := h.filter(h.linkType(ci))
+		if err != nil {
+			return nil, err
+		}
+		if bpf.Matches(ci, data) {
+			break
+		}
+	}
+	p := gopacket.NewPacket(data, h.linkType(ci), gopacket.Default)
+	md := p.Metadata()
+	md.CaptureInfo = ci
+	md.Truncated = md.Truncated || ci.CaptureLength < ci.Length
+
+	return p, nil
+}
+
+func (h *Handle) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	if h.ng == nil {
+		return h.src.LinkType()
+	}
+	i, err := h.ng.Interface(ci.InterfaceIndex)
+	if err != nil {
+		return h.src.LinkType()
+	}
+	return i.LinkType
+}
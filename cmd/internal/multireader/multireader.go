@@ -29,6 +29,19 @@ func New(ps []string) (io.Reader, error) {
 	return &m, nil
 }
 
+// Size gives the total size of the given files.
+func Size(ps []string) (int64, error) {
+	var z int64
+	for _, p := range ps {
+		i, err := os.Stat(p)
+		if err != nil {
+			return 0, err
+		}
+		z += i.Size()
+	}
+	return z, nil
+}
+
 func (m *multiReader) Read(bs []byte) (int, error) {
 	if len(m.files) == 0 && m.file == nil {
 		return 0, io.EOF
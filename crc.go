@@ -5,12 +5,32 @@ import (
 	"hash"
 )
 
-const (
-	vcduCITT = uint16(0xFFFF)
-	vcduPOLY = uint16(0x1021)
+// CRC16 defines a CRC-16 algorithm with the parameters of the Rocksoft model:
+// initial value, polynomial, reflection of the input bytes and of the output
+// and final XOR.
+type CRC16 struct {
+	Init   uint16
+	Poly   uint16
+	RefIn  bool
+	RefOut bool
+	XorOut uint16
+}
+
+// Presets of the CRC-16 algorithms commonly used for VCDU. The check value
+// (CRC of the ASCII string "123456789") of each preset is given in comment.
+var (
+	// CCITTFalse is the algorithm defined by the CCSDS for the VCDU (0x29B1).
+	CCITTFalse = CRC16{Init: 0xFFFF, Poly: 0x1021}
+	// X25 is the algorithm used by HDLC (0x906E).
+	X25 = CRC16{Init: 0xFFFF, Poly: 0x1021, RefIn: true, RefOut: true, XorOut: 0xFFFF}
+	// XModem is CCITTFalse with a zero initial value (0x31C3).
+	XModem = CRC16{Poly: 0x1021}
+	// Kermit is X25 with a zero initial value and no final XOR (0x2189).
+	Kermit = CRC16{Poly: 0x1021, RefIn: true, RefOut: true}
 )
 
 type vcduSum struct {
+	CRC16
 	sum uint16
 }
 
@@ -20,34 +40,48 @@ func Sum(bs []byte) uint16 {
 	return uint16(s.Sum32())
 }
 
+// SumVCDU gives a hash computing the CRC of VCDU with CCITTFalse.
 func SumVCDU() hash.Hash32 {
-	var v vcduSum
+	return SumVCDUWith(CCITTFalse)
+}
+
+// SumVCDUWith gives a hash computing the CRC of VCDU with the algorithm c.
+func SumVCDUWith(c CRC16) hash.Hash32 {
+	v := vcduSum{CRC16: c}
 	v.Reset()
 	return &v
 }
 
 func (v *vcduSum) Size() int      { return 2 }
 func (v *vcduSum) BlockSize() int { return 32 }
-func (v *vcduSum) Reset()         { v.sum = vcduCITT }
+func (v *vcduSum) Reset()         { v.sum = v.Init }
 
 func (v *vcduSum) Sum(bs []byte) []byte {
 	v.Write(bs)
 	vs := make([]byte, v.Size()*2)
-	binary.BigEndian.PutUint32(vs, uint32(v.sum))
+	binary.BigEndian.PutUint32(vs, v.Sum32())
 
 	return vs
 }
 
 func (v *vcduSum) Sum32() uint32 {
-	return uint32(v.sum)
+	sum := v.sum
+	if v.RefOut {
+		sum = reflect16(sum)
+	}
+	return uint32(sum ^ v.XorOut)
 }
 
 func (v *vcduSum) Write(bs []byte) (int, error) {
 	for i := 0; i < len(bs); i++ {
-		v.sum ^= uint16(bs[i]) << 8
+		b := bs[i]
+		if v.RefIn {
+			b = reflect8(b)
+		}
+		v.sum ^= uint16(b) << 8
 		for j := 0; j < 8; j++ {
 			if (v.sum & 0x8000) > 0 {
-				v.sum = (v.sum << 1) ^ vcduPOLY
+				v.sum = (v.sum << 1) ^ v.Poly
 			} else {
 				v.sum = v.sum << 1
 			}
@@ -55,3 +89,16 @@ func (v *vcduSum) Write(bs []byte) (int, error) {
 	}
 	return len(bs), nil
 }
+
+func reflect8(b byte) byte {
+	var r byte
+	for i := 0; i < 8; i++ {
+		r = r<<1 | b&1
+		b >>= 1
+	}
+	return r
+}
+
+func reflect16(v uint16) uint16 {
+	return uint16(reflect8(byte(v)))<<8 | uint16(reflect8(byte(v>>8)))
+}
@@ -0,0 +1,27 @@
+package erdle_test
+
+import (
+	"testing"
+
+	"github.com/busoc/erdle"
+)
+
+func TestCRC16Presets(t *testing.T) {
+	data := []struct {
+		Name  string
+		CRC   erdle.CRC16
+		Check uint32
+	}{
+		{Name: "ccitt-false", CRC: erdle.CCITTFalse, Check: 0x29B1},
+		{Name: "x25", CRC: erdle.X25, Check: 0x906E},
+		{Name: "xmodem", CRC: erdle.XModem, Check: 0x31C3},
+		{Name: "kermit", CRC: erdle.Kermit, Check: 0x2189},
+	}
+	for _, d := range data {
+		s := erdle.SumVCDUWith(d.CRC)
+		s.Write([]byte("123456789"))
+		if got := s.Sum32(); got != d.Check {
+			t.Errorf("%s: want %04x, got %04x", d.Name, d.Check, got)
+		}
+	}
+}
@@ -29,21 +29,37 @@ const (
 )
 
 func StuffBytes(bs []byte) []byte {
-	offset := WordLen * 2
+	xs := make([]byte, StuffLen(bs))
+	return xs[:StuffInto(bs, xs)]
+}
+
+// StuffLen gives the length of bs once stuffed.
+func StuffLen(bs []byte) int {
+	if len(bs) <= WordLen*2 {
+		return len(bs)
+	}
+	return len(bs) + bytes.Count(bs[WordLen*2:], Word)
+}
 
-	xs := make([]byte, 0, len(bs))
-	xs = append(xs, bs[:offset]...)
+// StuffInto writes the stuffed bytes of src into dst and returns the number of
+// bytes written. dst should have at least StuffLen(src) bytes.
+func StuffInto(src, dst []byte) int {
+	offset := WordLen * 2
+	if len(src) < offset {
+		return copy(dst, src)
+	}
+	nn := copy(dst, src[:offset])
 	for {
-		if ix := bytes.Index(bs[offset:], Word); ix < 0 {
+		if ix := bytes.Index(src[offset:], Word); ix < 0 {
 			break
 		} else {
-			xs = append(xs, bs[offset:offset+ix]...)
-			xs = append(xs, Stuff...)
+			nn += copy(dst[nn:], src[offset:offset+ix])
+			nn += copy(dst[nn:], Stuff)
 
 			offset += ix + WordLen - 1
 		}
 	}
-	return append(xs, bs[offset:]...)
+	return nn + copy(dst[nn:], src[offset:])
 }
 
 func Unstuff(bs []byte) (int, []byte) {
@@ -51,6 +67,48 @@ func Unstuff(bs []byte) (int, []byte) {
 	return UnstuffBytes(bs, xs), xs
 }
 
+// CheckStuff verifies that each stuff marker found in the stuffed packet bs
+// (starting with the synchronization word and the size) is immediately
+// followed by the last byte of the synchronization word.
+func CheckStuff(bs []byte) error {
+	offset := WordLen * 2
+	if len(bs) < offset {
+		return nil
+	}
+	for {
+		ix := bytes.Index(bs[offset:], Stuff)
+		if ix < 0 {
+			return nil
+		}
+		ix += offset
+		if next := ix + len(Stuff); next >= len(bs) || bs[next] != Word[WordLen-1] {
+			return StuffError{Offset: ix}
+		}
+		offset = ix + len(Stuff)
+	}
+}
+
+// UnstuffInto writes the unstuffed bytes of src into dst and returns the number
+// of bytes written. dst should have at least len(src) bytes. Since unstuffing
+// never moves a byte forward, dst can be src to unstuff a packet in place.
+func UnstuffInto(src, dst []byte) int {
+	return UnstuffBytes(src, dst)
+}
+
+// UnstuffLen gives the length of the stuffed packet src once unstuffed by
+// UnstuffBytes without unstuffing it.
+func UnstuffLen(src []byte) int {
+	z, n := int(binary.LittleEndian.Uint32(src[4:]))+12, len(src)
+	if d := n - z; d > 0 && d%CaduBodyLen == 0 {
+		n -= d
+	}
+	if n > z {
+		// each stuff marker is replaced by the last 3 bytes of the word
+		n -= bytes.Count(src[:n], Stuff) * (len(Stuff) - 3)
+	}
+	return n
+}
+
 func UnstuffBytes(src, dst []byte) int {
 	z, n := int(binary.LittleEndian.Uint32(src[4:]))+12, len(src)
 	if d := n - z; d > 0 && d%CaduBodyLen == 0 {
@@ -73,6 +131,17 @@ func UnstuffBytes(src, dst []byte) int {
 
 var ErrMagic = errors.New("cadu: invalid magic")
 
+// ResyncError reports the number of bytes skipped by a reader created with
+// WithResync to find the beginning of the next frame. The frame given with the
+// error is valid.
+type ResyncError struct {
+	Skipped int
+}
+
+func (e ResyncError) Error() string {
+	return fmt.Sprintf("resynchronized: %d bytes skipped", e.Skipped)
+}
+
 type MissingCaduError struct {
 	From, To uint32
 }
@@ -81,6 +150,16 @@ func (e MissingCaduError) Error() string {
 	return fmt.Sprintf("%d missing cadus (%d - %d)", ((e.To-e.From)&0xFFFFFF)-1, e.From, e.To)
 }
 
+// OutOfOrderError reports a frame whose counter is behind the counter of the
+// previous frame by less than the reorder window of the reader.
+type OutOfOrderError struct {
+	Prev, Curr uint32
+}
+
+func (e OutOfOrderError) Error() string {
+	return fmt.Sprintf("out of order cadu: %d received after %d", e.Curr, e.Prev)
+}
+
 type CRCError struct {
 	Want, Got uint16
 }
@@ -89,17 +168,93 @@ func (c CRCError) Error() string {
 	return fmt.Sprintf("invalid crc: want %04x, got %04x", c.Want, c.Got)
 }
 
+// TruncatedCaduError reports the bytes left at the end of a stream that are not
+// enough to make a full frame (see FrameAlignedReader).
+type TruncatedCaduError struct {
+	Size int
+}
+
+func (e TruncatedCaduError) Error() string {
+	return fmt.Sprintf("truncated cadu: %d bytes left", e.Size)
+}
+
+// ChecksumError reports a HRDL packet with an invalid checksum. When Located is
+// true, FirstCadu and LastCadu give the counters of the cadus that carried the
+// packet.
+type ChecksumError struct {
+	Want, Got uint32
+
+	FirstCadu uint32
+	LastCadu  uint32
+	Located   bool
+}
+
+func (c ChecksumError) Error() string {
+	if c.Located {
+		return fmt.Sprintf("invalid checksum: want %08x, got %08x (packet starting at cadu %d, ending at cadu %d)", c.Want, c.Got, c.FirstCadu, c.LastCadu)
+	}
+	return fmt.Sprintf("invalid checksum: want %08x, got %08x", c.Want, c.Got)
+}
+
+// StuffError reports a stuff marker that is not followed by the last byte of
+// the synchronization word. Offset is the position of the marker in the packet.
+type StuffError struct {
+	Offset int
+}
+
+func (e StuffError) Error() string {
+	return fmt.Sprintf("invalid stuff bytes at offset %d", e.Offset)
+}
+
+type LengthError struct {
+	Want, Got int
+}
+
+func (e LengthError) Error() string {
+	return fmt.Sprintf("invalid length: want %d, got %d", e.Want, e.Got)
+}
+
 func IsMissingCadu(err error) (int, bool) {
 	e, ok := err.(MissingCaduError)
 	return int((e.To - e.From) & 0xFFFFFF), ok
 }
 
+func IsOutOfOrder(err error) bool {
+	_, ok := err.(OutOfOrderError)
+	return ok
+}
+
+func IsResync(err error) (int, bool) {
+	e, ok := err.(ResyncError)
+	return e.Skipped, ok
+}
+
 func IsCRCError(err error) bool {
 	_, ok := err.(CRCError)
 	return ok
 }
 
+func IsTruncatedCadu(err error) bool {
+	_, ok := err.(TruncatedCaduError)
+	return ok
+}
+
+func IsChecksumError(err error) bool {
+	_, ok := err.(ChecksumError)
+	return ok
+}
+
+func IsStuffError(err error) bool {
+	_, ok := err.(StuffError)
+	return ok
+}
+
+func IsLengthError(err error) bool {
+	_, ok := err.(LengthError)
+	return ok
+}
+
 func IsCaduError(err error) bool {
 	_, ok := IsMissingCadu(err)
-	return ok || IsCRCError(err) || err == ErrMagic
+	return ok || IsCRCError(err) || IsOutOfOrder(err) || err == ErrMagic
 }
@@ -0,0 +1,70 @@
+package erdle_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+// stuffedPacket gives a packet whose payload contains n synchronization words
+// (so n stuff markers once stuffed).
+func stuffedPacket(n int) []byte {
+	payload := bytes.Repeat(append(bytes.Repeat([]byte{0x11}, 60), erdle.Word...), n)
+	return erdletest.BuildHRDL(erdle.HRDLHeader{Channel: 1}, payload)
+}
+
+func BenchmarkStuff(b *testing.B) {
+	n, bs := erdle.Unstuff(stuffedPacket(64))
+	bs = bs[:n]
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(bs)))
+		for i := 0; i < b.N; i++ {
+			erdle.StuffBytes(bs)
+		}
+	})
+	b.Run("into", func(b *testing.B) {
+		dst := make([]byte, erdle.StuffLen(bs))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(bs)))
+		for i := 0; i < b.N; i++ {
+			erdle.StuffInto(bs, dst)
+		}
+	})
+}
+
+func BenchmarkUnstuff(b *testing.B) {
+	bs := stuffedPacket(64)
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(bs)))
+		for i := 0; i < b.N; i++ {
+			erdle.Unstuff(bs)
+		}
+	})
+	b.Run("into", func(b *testing.B) {
+		dst := make([]byte, len(bs))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(bs)))
+		for i := 0; i < b.N; i++ {
+			erdle.UnstuffInto(bs, dst)
+		}
+	})
+}
+
+func TestUnstuffInPlace(t *testing.T) {
+	bs := stuffedPacket(8)
+	n, want := erdle.Unstuff(bs)
+
+	got := append([]byte{}, bs...)
+	if m := erdle.UnstuffInto(got, got); m != n || !bytes.Equal(got[:m], want[:n]) {
+		t.Fatalf("unstuffing in place differs from Unstuff")
+	}
+	if n != len(bs)-8 {
+		t.Fatalf("unexpected length: want %d, got %d", len(bs)-8, n)
+	}
+}
@@ -0,0 +1,38 @@
+// Package erdletest provides helpers to build synthetic cadus and HRDL packets
+// for testing the readers and the reassemblers of the erdle package.
+package erdletest
+
+import (
+	"bytes"
+
+	"github.com/busoc/erdle"
+)
+
+// BuildCadu creates a valid cadu with the given counter, virtual channel and
+// body (see erdle.EncodeCadu).
+func BuildCadu(counter uint32, vc uint8, body []byte) []byte {
+	return erdle.EncodeCadu(counter, vc, body)
+}
+
+// BuildHRDL creates a stuffed HRDL packet from the given header and payload
+// (see erdle.EncodeHRDL).
+func BuildHRDL(h erdle.HRDLHeader, payload []byte) []byte {
+	return erdle.EncodeHRDL(h, payload)
+}
+
+// BuildStream splits the given HRDL packets into cadus of the virtual channel
+// vc. The counter of the first cadu is given by counter.
+func BuildStream(counter uint32, vc uint8, packets ...[]byte) [][]byte {
+	var (
+		buf bytes.Buffer
+		cs  [][]byte
+	)
+	for _, p := range packets {
+		buf.Write(p)
+	}
+	for buf.Len() > 0 {
+		cs = append(cs, BuildCadu(counter, vc, buf.Next(erdle.CaduBodyLen)))
+		counter = (counter + 1) & erdle.CaduCounterMask
+	}
+	return cs
+}
@@ -0,0 +1,212 @@
+package erdle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/busoc/timutil"
+)
+
+const (
+	HRDLSizeLen    = 4
+	HRDLTrailerLen = 4
+	VMUHeaderLen   = 16
+	DataHeaderLen  = 24
+	UPILen         = 32
+	ImageHeaderLen = 52
+)
+
+const (
+	TypeUnknown uint8 = iota
+	TypeScience
+	TypeImage
+)
+
+type HRDLHeader struct {
+	Size uint32
+
+	Channel  uint8
+	Source   uint8
+	Sequence uint32
+	When     time.Time
+
+	Property uint8
+	Stream   uint16
+	Counter  uint32
+	Acqtime  time.Time
+	Auxtime  time.Time
+	Origin   uint8
+	UPI      string
+}
+
+func (h HRDLHeader) Type() uint8 {
+	switch t := h.Property >> 4; t {
+	case TypeScience, TypeImage:
+		return t
+	default:
+		return TypeUnknown
+	}
+}
+
+func (h HRDLHeader) Realtime() bool {
+	return h.Source == h.Origin
+}
+
+// HRDFEHeaderLen is the length of the header written before each cadu in HRDFE
+// files.
+const HRDFEHeaderLen = 8
+
+// DecodeHRDFEHeader decodes the reception time written before a cadu in HRDFE
+// files: the number of seconds since the unix epoch followed by 4 zero bytes
+// (both big endian).
+func DecodeHRDFEHeader(bs []byte) (time.Time, error) {
+	if len(bs) < HRDFEHeaderLen {
+		return time.Time{}, LengthError{Want: HRDFEHeaderLen, Got: len(bs)}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(bs)), 0).UTC(), nil
+}
+
+// DecodeHRDLHeader decodes the headers of a HRDL packet. The given bytes can
+// start either with the synchronization word followed by the size of the packet
+// or directly with the VMU header. Size is only set in the former case.
+func DecodeHRDLHeader(bs []byte) (HRDLHeader, error) {
+	var h HRDLHeader
+	if bytes.HasPrefix(bs, Word) {
+		if len(bs) < WordLen+HRDLSizeLen {
+			return h, LengthError{Want: WordLen + HRDLSizeLen, Got: len(bs)}
+		}
+		h.Size = binary.LittleEndian.Uint32(bs[WordLen:])
+		bs = bs[WordLen+HRDLSizeLen:]
+	}
+	if len(bs) < VMUHeaderLen {
+		return h, LengthError{Want: VMUHeaderLen, Got: len(bs)}
+	}
+	h.Channel = bs[0]
+	h.Source = bs[1]
+	h.Sequence = binary.LittleEndian.Uint32(bs[4:])
+	h.When = timutil.Join6(binary.LittleEndian.Uint32(bs[8:]), binary.LittleEndian.Uint16(bs[12:]))
+
+	bs = bs[VMUHeaderLen:]
+	if len(bs) < DataHeaderLen {
+		return h, nil
+	}
+	h.Property = bs[0]
+	h.Stream = binary.LittleEndian.Uint16(bs[1:])
+	h.Counter = binary.LittleEndian.Uint32(bs[3:])
+	h.Acqtime = timutil.GPS.Add(time.Duration(binary.LittleEndian.Uint64(bs[7:])))
+	h.Auxtime = timutil.GPS.Add(time.Duration(binary.LittleEndian.Uint64(bs[15:])))
+	h.Origin = bs[23]
+
+	bs = bs[DataHeaderLen:]
+	switch h.Type() {
+	case TypeScience:
+		if len(bs) >= UPILen {
+			h.UPI = upiString(bs[:UPILen])
+		}
+	case TypeImage:
+		if len(bs) >= ImageHeaderLen {
+			h.UPI = upiString(bs[ImageHeaderLen-UPILen : ImageHeaderLen])
+		}
+	}
+	return h, nil
+}
+
+// SciencePayload gives the payload of the science packet bs, after the UPI
+// block. It returns false if bs is not a science packet or if it is too short.
+//
+// As for DecodeHRDLHeader, bs can start with the synchronization word or with
+// the VMU header. In both cases, bs should end with the checksum of the packet
+// that is not part of the payload.
+func SciencePayload(bs []byte) ([]byte, bool) {
+	return payloadOf(bs, TypeScience, UPILen)
+}
+
+// ImagePayload is like SciencePayload for image packets. The payload starts
+// after the image header (that contains the UPI).
+func ImagePayload(bs []byte) ([]byte, bool) {
+	return payloadOf(bs, TypeImage, ImageHeaderLen)
+}
+
+func payloadOf(bs []byte, kind uint8, offset int) ([]byte, bool) {
+	if bytes.HasPrefix(bs, Word) {
+		if len(bs) < WordLen+HRDLSizeLen {
+			return nil, false
+		}
+		if z := int(binary.LittleEndian.Uint32(bs[WordLen:])) + 12; z <= len(bs) {
+			bs = bs[:z]
+		}
+		bs = bs[WordLen+HRDLSizeLen:]
+	}
+	offset += VMUHeaderLen + DataHeaderLen
+	if len(bs) < offset+HRDLTrailerLen {
+		return nil, false
+	}
+	if bs[VMUHeaderLen]>>4 != kind {
+		return nil, false
+	}
+	return bs[offset : len(bs)-HRDLTrailerLen], true
+}
+
+func upiString(bs []byte) string {
+	return string(bytes.Trim(bs, "\x00 "))
+}
+
+// EncodeHRDL creates a stuffed HRDL packet (synchronization word, size, headers,
+// payload and checksum) from the given header and payload. The Size of h is
+// ignored and computed from the payload. The UPI is only written for science
+// and image packets.
+func EncodeHRDL(h HRDLHeader, payload []byte) []byte {
+	var body bytes.Buffer
+
+	coarse, fine := timutil.Split6(h.When)
+	body.WriteByte(h.Channel)
+	body.WriteByte(h.Source)
+	body.Write(make([]byte, 2))
+	binary.Write(&body, binary.LittleEndian, h.Sequence)
+	binary.Write(&body, binary.LittleEndian, coarse)
+	binary.Write(&body, binary.LittleEndian, fine)
+	body.Write(make([]byte, 2))
+
+	body.WriteByte(h.Property)
+	binary.Write(&body, binary.LittleEndian, h.Stream)
+	binary.Write(&body, binary.LittleEndian, h.Counter)
+	binary.Write(&body, binary.LittleEndian, sinceGPS(h.Acqtime))
+	binary.Write(&body, binary.LittleEndian, sinceGPS(h.Auxtime))
+	body.WriteByte(h.Origin)
+
+	switch h.Type() {
+	case TypeScience:
+		body.Write(upiBytes(h.UPI))
+	case TypeImage:
+		body.Write(make([]byte, ImageHeaderLen-UPILen))
+		body.Write(upiBytes(h.UPI))
+	}
+	body.Write(payload)
+
+	var buf bytes.Buffer
+	buf.Write(Word)
+	binary.Write(&buf, binary.LittleEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+
+	var sum uint32
+	for _, b := range buf.Bytes()[WordLen+HRDLSizeLen:] {
+		sum += uint32(b)
+	}
+	binary.Write(&buf, binary.LittleEndian, sum)
+
+	return StuffBytes(buf.Bytes())
+}
+
+func sinceGPS(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Sub(timutil.GPS))
+}
+
+func upiBytes(upi string) []byte {
+	bs := make([]byte, UPILen)
+	copy(bs, upi)
+	return bs
+}
@@ -0,0 +1,157 @@
+package erdle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Provenance is a reassembled HRDL packet with the counters of the first and
+// last cadus that carried it. Missing is the number of cadus lost since the
+// previous packet given.
+type Provenance struct {
+	Packet    []byte
+	FirstCadu uint32
+	LastCadu  uint32
+	Missing   uint32
+}
+
+// Verify verifies the length and the checksum of the packet. The ChecksumError
+// returned gives the cadus that carried the packet.
+func (p Provenance) Verify() error {
+	bs := p.Packet
+	if len(bs) < WordLen+HRDLSizeLen+HRDLTrailerLen {
+		return LengthError{Want: WordLen + HRDLSizeLen + HRDLTrailerLen, Got: len(bs)}
+	}
+	z := int(binary.LittleEndian.Uint32(bs[WordLen:])) + WordLen + HRDLSizeLen + HRDLTrailerLen
+	if z > len(bs) {
+		return LengthError{Want: z, Got: len(bs)}
+	}
+	var sum uint32
+	for _, b := range bs[WordLen+HRDLSizeLen : z-HRDLTrailerLen] {
+		sum += uint32(b)
+	}
+	if want := binary.LittleEndian.Uint32(bs[z-HRDLTrailerLen:]); want != sum {
+		return ChecksumError{
+			Want:      want,
+			Got:       sum,
+			FirstCadu: p.FirstCadu,
+			LastCadu:  p.LastCadu,
+			Located:   true,
+		}
+	}
+	return nil
+}
+
+// ReassembleWithProvenance reassembles the HRDL packets from the cadus read
+// from r. If hrdfe is true, the 8 bytes header written before each cadu in
+// HRDFE files are skipped. Packets whose cadus are missing or corrupted are
+// discarded. The returned channel is closed when r is exhausted or returns an
+// error that is not related to a cadu.
+func ReassembleWithProvenance(r io.Reader, hrdfe bool) <-chan Provenance {
+	var skip int
+	if hrdfe {
+		skip = 8
+	}
+	return ReassembleFrames(VCDUReader(r, skip))
+}
+
+// ReassembleFrames is like ReassembleWithProvenance but reads the frames from r
+// that should give one full frame for each call to Read, like the readers
+// returned by VCDUReader and ChannelFilter.
+func ReassembleFrames(r io.Reader) <-chan Provenance {
+	q := make(chan Provenance)
+	go func() {
+		defer close(q)
+		reassemble(r, q)
+	}()
+	return q
+}
+
+func reassemble(r io.Reader, q chan<- Provenance) {
+	var (
+		frame   = make([]byte, CaduLen)
+		buffer  []byte
+		started bool
+		first   uint32
+		prev    uint32
+		missing uint32
+	)
+	for {
+		_, err := r.Read(frame)
+		if err != nil {
+			if n, ok := IsMissingCadu(err); ok {
+				// the frame following a gap is valid but the packet being
+				// reassembled is lost.
+				missing += uint32(n)
+				buffer, started = buffer[:0], false
+			} else if IsCRCError(err) {
+				buffer, started = buffer[:0], false
+				continue
+			} else {
+				return
+			}
+		}
+		curr := binary.BigEndian.Uint32(frame[6:]) >> 8
+		body := frame[CaduHeaderLen:CaduTrailerIndex]
+
+		offset := len(buffer)
+		buffer = append(buffer, body...)
+		if !started {
+			ix := bytes.Index(buffer, Word)
+			if ix < 0 {
+				if n := len(buffer) - WordLen; n > 0 {
+					buffer = append(buffer[:0], buffer[n:]...)
+				}
+				prev = curr
+				continue
+			}
+			buffer = append(buffer[:0], buffer[ix:]...)
+			if ix < offset {
+				first = prev
+			} else {
+				first = curr
+			}
+			if offset -= ix; offset < 0 {
+				offset = 0
+			}
+			started = true
+		}
+		for {
+			from := offset - WordLen
+			if from < WordLen {
+				from = WordLen
+			}
+			ix := bytes.Index(buffer[from:], Word)
+			if ix < 0 {
+				break
+			}
+			ix += from
+
+			last, next := curr, curr
+			if ix <= offset {
+				last = prev
+				if ix < offset {
+					next = prev
+				}
+			}
+			if ix >= WordLen+HRDLSizeLen {
+				n, xs := Unstuff(buffer[:ix])
+				q <- Provenance{
+					Packet:    xs[:n],
+					FirstCadu: first,
+					LastCadu:  last,
+					Missing:   missing,
+				}
+				missing = 0
+			}
+			first = next
+
+			buffer = append(buffer[:0], buffer[ix:]...)
+			if offset -= ix; offset < 0 {
+				offset = 0
+			}
+		}
+		prev = curr
+	}
+}
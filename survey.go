@@ -0,0 +1,83 @@
+package erdle
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// SurveyReport gives the completeness of a stream of cadus.
+type SurveyReport struct {
+	Frames  int
+	Missing int
+	CRC     int
+	Fill    int
+	// Reordered is only counted when the reader has a reorder window (see
+	// WithReorderWindow).
+	Reordered int
+
+	First uint32
+	Last  uint32
+}
+
+// Expected gives the number of frames that should have been received.
+func (s SurveyReport) Expected() int {
+	return s.Frames + s.Missing
+}
+
+// Completeness gives the ratio of frames received over the frames expected.
+func (s SurveyReport) Completeness() float64 {
+	if s.Expected() == 0 {
+		return 0
+	}
+	return float64(s.Frames) / float64(s.Expected())
+}
+
+// Survey reads all the cadus from r and reports the frames received, missing
+// and corrupted. Fill frames are detected with IsFillCadu (with a zero pattern).
+//
+// If r is not a reader returned by VCDUReader or CaduReader, it is wrapped
+// with VCDUReader (without bytes to skip). A reader returned by CaduReader is
+// not modified: the frames are read from its underlying reader with the same
+// options. The frame given with a ResyncError is counted as any other frame.
+// Survey stops without error at the end of r. Any error that is not related to
+// a frame is returned with the report computed so far.
+func Survey(r io.Reader) (SurveyReport, error) {
+	var s SurveyReport
+
+	// the body of the frames is needed to detect fill frames
+	v := frameReader(r)
+
+	frame := make([]byte, CaduLen)
+	for {
+		n, err := v.Read(frame)
+		if err == io.EOF {
+			break
+		}
+		if e, ok := err.(MissingCaduError); ok {
+			s.Missing += int((e.To-e.From)&CaduCounterMask) - 1
+		} else if IsCRCError(err) {
+			s.CRC++
+		} else if IsOutOfOrder(err) {
+			s.Reordered++
+		} else if _, ok := IsResync(err); ok {
+			// the frame following the skipped bytes is valid
+		} else if err != nil {
+			return s, err
+		}
+		if n < CaduLen {
+			continue
+		}
+		curr := binary.BigEndian.Uint32(frame[6:]) >> 8
+		if s.Frames == 0 {
+			s.First = curr
+		}
+		if !IsOutOfOrder(err) {
+			s.Last = curr
+		}
+		s.Frames++
+		if IsFillCadu(frame, 0) {
+			s.Fill++
+		}
+	}
+	return s, nil
+}
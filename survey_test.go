@@ -0,0 +1,69 @@
+package erdle_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+func TestSurveyCaduReader(t *testing.T) {
+	buf := buildStream(1, 2, 4)
+	r := erdle.CaduReader(buf, 0)
+
+	s, err := erdle.Survey(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Frames != 3 || s.Missing != 1 {
+		t.Fatalf("unexpected report: %d frames, %d missing", s.Frames, s.Missing)
+	}
+	// r still gives the bodies of the cadus
+	body := bytes.Repeat([]byte{0x22}, erdle.CaduBodyLen)
+	buf.Write(erdletest.BuildCadu(5, 1, body))
+	xs := make([]byte, erdle.CaduBodyLen)
+	if _, err := r.Read(xs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(xs, body) {
+		t.Fatalf("reader given to Survey no longer gives bodies")
+	}
+}
+
+func TestSurveyResync(t *testing.T) {
+	buf := buildStream(1)
+	buf.WriteByte(0x1a)
+	buf.Write(erdletest.BuildCadu(2, 1, nil))
+	buf.Write(erdletest.BuildCadu(3, 1, nil))
+
+	s, err := erdle.Survey(erdle.VCDUReader(buf, 0, erdle.WithResync()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Frames != 3 || s.Missing != 0 || s.Last != 3 {
+		t.Fatalf("unexpected report: %d frames, %d missing (last: %d)", s.Frames, s.Missing, s.Last)
+	}
+}
+
+func TestChannelsResync(t *testing.T) {
+	var (
+		h1 = erdle.HRDLHeader{Channel: 1, Sequence: 1}
+		h2 = erdle.HRDLHeader{Channel: 2, Sequence: 1}
+	)
+	var buf bytes.Buffer
+	for _, c := range erdletest.BuildStream(1, 1, erdletest.BuildHRDL(h1, make([]byte, 100))) {
+		buf.Write(c)
+	}
+	buf.WriteByte(0x1a)
+	for _, c := range erdletest.BuildStream(2, 1, erdletest.BuildHRDL(h2, make([]byte, 100))) {
+		buf.Write(c)
+	}
+	cs, err := erdle.Channels(erdle.VCDUReader(&buf, 0, erdle.WithResync()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(cs, []uint8{1, 2}) {
+		t.Fatalf("unexpected channels: %v", cs)
+	}
+}
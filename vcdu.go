@@ -5,70 +5,352 @@ import (
 	"encoding/binary"
 	"hash"
 	"io"
+
+	"github.com/juju/ratelimit"
 )
 
 type vcduReader struct {
 	skip    int
 	inner   io.Reader
 	counter uint32
+	seen    bool
 	body    bool
 	digest  hash.Hash32
+	window  uint32
+	resync  bool
+
+	// channels and counters are only set by ChannelFilter
+	channels map[uint8]struct{}
+	counters map[uint8]uint32
 }
 
-func CaduReader(r io.Reader, skip int) io.Reader {
-	return &vcduReader{
+// ReaderOption configures the readers returned by CaduReader and VCDUReader.
+type ReaderOption func(*vcduReader)
+
+// WithCRC makes the reader verify the CRC of the frames with the algorithm c
+// instead of CCITTFalse.
+func WithCRC(c CRC16) ReaderOption {
+	return func(r *vcduReader) {
+		r.digest = SumVCDUWith(c)
+	}
+}
+
+// WithReorderWindow makes the reader report the frames whose counter is behind
+// the counter of the previous frame by at most n as OutOfOrderError instead of
+// MissingCaduError. The counter of the reader is not updated by these frames.
+//
+// Since frames are not buffered, the gap left by a frame arriving late is still
+// reported as a MissingCaduError before the frame is received.
+func WithReorderWindow(n uint32) ReaderOption {
+	return func(r *vcduReader) {
+		r.window = n
+	}
+}
+
+// WithResync makes the reader scan forward for the next Magic when the bytes
+// read at the position of a frame do not start with it (eg after a truncated
+// frame in the middle of concatenated files) instead of returning ErrMagic. A
+// frame with an invalid CRC that contains Magic is also considered as truncated
+// and the reader realigns on the frame starting within its bytes.
+//
+// The first frame read once realigned is given with a ResyncError reporting the
+// number of bytes skipped, unless another error is reported for this frame.
+func WithResync() ReaderOption {
+	return func(r *vcduReader) {
+		r.resync = true
+	}
+}
+
+func CaduReader(r io.Reader, skip int, opts ...ReaderOption) io.Reader {
+	v := vcduReader{
 		skip:   skip,
 		inner:  r,
 		body:   true,
 		digest: SumVCDU(),
 	}
+	for _, o := range opts {
+		o(&v)
+	}
+	return &v
 }
 
-func VCDUReader(r io.Reader, skip int) io.Reader {
-	return &vcduReader{
+func VCDUReader(r io.Reader, skip int, opts ...ReaderOption) io.Reader {
+	v := vcduReader{
 		skip:   skip,
 		inner:  r,
 		digest: SumVCDU(),
 	}
+	for _, o := range opts {
+		o(&v)
+	}
+	return &v
+}
+
+// frameReader gives a reader of full frames for Survey and Channels. If r is a
+// reader returned by CaduReader, a new reader with the same options reads from
+// its underlying reader so that r itself keeps giving bodies only.
+func frameReader(r io.Reader) *vcduReader {
+	v, ok := r.(*vcduReader)
+	if !ok {
+		return VCDUReader(r, 0).(*vcduReader)
+	}
+	if !v.body {
+		return v
+	}
+	w := *v
+	w.body = false
+	return &w
+}
+
+// ChannelFilter gives the frames read from r that belong to one of the given
+// virtual channels. Frames of the other channels are dropped.
+//
+// The virtual channels of a stream are sequenced independently: the counter of
+// each frame is compared with the counter of the previous frame of the same
+// channel to detect missing frames. Since HRDL packets are not split across
+// channels, only one channel should be selected when the frames are given to
+// ReassembleFrames.
+func ChannelFilter(r io.Reader, channels ...uint8) io.Reader {
+	cs := make(map[uint8]struct{})
+	for _, c := range channels {
+		cs[c&0x3F] = struct{}{}
+	}
+	return &vcduReader{
+		inner:    r,
+		digest:   SumVCDU(),
+		channels: cs,
+		counters: make(map[uint8]uint32),
+	}
 }
 
 func (r *vcduReader) Read(bs []byte) (int, error) {
 	defer r.digest.Reset()
 	xs := make([]byte, r.skip+CaduLen)
 
-	n, err := io.ReadFull(r.inner, xs)
-	if err != nil {
-		return n, err
-	}
-	if n == 0 {
-		return r.Read(bs)
-	}
-	if !bytes.HasPrefix(xs[r.skip:], Magic) {
-		return 0, ErrMagic
-	}
-	if s := r.digest.Sum(xs[r.skip+4 : r.skip+CaduTrailerIndex]); !bytes.Equal(s[2:], xs[r.skip+CaduTrailerIndex:r.skip+CaduLen]) {
-		err = CRCError{
-			Want: binary.BigEndian.Uint16(xs[r.skip+CaduTrailerIndex:]),
-			Got:  binary.BigEndian.Uint16(s[2:]),
+	var (
+		n       int
+		err     error
+		skipped int
+		fill    = true
+	)
+	for {
+		if fill {
+			n, err = io.ReadFull(r.inner, xs)
+			if err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+		}
+		fill = true
+		if !bytes.HasPrefix(xs[r.skip:], Magic) {
+			if !r.resync {
+				return 0, ErrMagic
+			}
+			n, err = r.realign(xs)
+			if skipped += n; err != nil {
+				return 0, err
+			}
+		}
+		if err = r.verify(xs); r.resync && err != nil {
+			// the frame is truncated if the next one starts within its bytes
+			if ix := bytes.Index(xs[r.skip+1:], Magic); ix >= 0 {
+				if err = r.shift(xs, ix+1); err != nil {
+					return 0, err
+				}
+				skipped, fill = skipped+ix+1, false
+				continue
+			}
+		}
+		if r.channels == nil {
+			break
+		}
+		if _, ok := r.channels[xs[r.skip+5]&0x3F]; ok {
+			break
 		}
 	}
 
+	prev, seen := r.counter, r.seen
+	if r.counters != nil {
+		prev, seen = r.counters[xs[r.skip+5]&0x3F]
+	}
 	curr := binary.BigEndian.Uint32(xs[r.skip+6:]) >> 8
-	if curr < r.counter {
+	// the first frame can not be late: there is no previous frame to compare with
+	if back := (prev - curr) & CaduCounterMask; seen && back > 0 && back <= r.window {
 		if err == nil {
-			err = MissingCaduError{From: curr, To: r.counter}
+			err = OutOfOrderError{Prev: prev, Curr: curr}
 		}
+		return r.copyFrame(bs, xs), err
 	}
-	if diff := (curr - r.counter) & CaduCounterMask; diff != curr && diff > 1 {
+	if curr < prev {
 		if err == nil {
-			err = MissingCaduError{From: r.counter, To: curr}
+			err = MissingCaduError{From: curr, To: prev}
 		}
 	}
-	r.counter = curr
-	if r.body {
-		n = copy(bs, xs[r.skip+CaduHeaderLen:r.skip+CaduTrailerIndex])
+	if diff := (curr - prev) & CaduCounterMask; diff != curr && diff > 1 {
+		if err == nil {
+			err = MissingCaduError{From: prev, To: curr}
+		}
+	}
+	if r.counters != nil {
+		r.counters[xs[r.skip+5]&0x3F] = curr
 	} else {
-		n = copy(bs, xs[r.skip:])
+		r.counter, r.seen = curr, true
+	}
+	if err == nil && skipped > 0 {
+		err = ResyncError{Skipped: skipped}
+	}
+	return r.copyFrame(bs, xs), err
+}
+
+// verify gives a CRCError if the CRC of the frame xs is invalid.
+func (r *vcduReader) verify(xs []byte) error {
+	r.digest.Reset()
+	s := r.digest.Sum(xs[r.skip+4 : r.skip+CaduTrailerIndex])
+	if bytes.Equal(s[2:], xs[r.skip+CaduTrailerIndex:r.skip+CaduLen]) {
+		return nil
+	}
+	return CRCError{
+		Want: binary.BigEndian.Uint16(xs[r.skip+CaduTrailerIndex:]),
+		Got:  binary.BigEndian.Uint16(s[2:]),
+	}
+}
+
+// realign shifts the bytes of xs until Magic is found at the position of the
+// synchronization marker of the frame. It gives the number of bytes dropped.
+func (r *vcduReader) realign(xs []byte) (int, error) {
+	var skipped int
+	for !bytes.HasPrefix(xs[r.skip:], Magic) {
+		n := len(xs) - r.skip - len(Magic) + 1
+		if ix := bytes.Index(xs[r.skip+1:], Magic); ix >= 0 {
+			n = ix + 1
+		}
+		skipped += n
+		if err := r.shift(xs, n); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// shift drops the first n bytes of xs and fills it again from the inner reader.
+func (r *vcduReader) shift(xs []byte, n int) error {
+	copy(xs, xs[n:])
+	_, err := io.ReadFull(r.inner, xs[len(xs)-n:])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return err
+}
+
+func (r *vcduReader) copyFrame(bs, xs []byte) int {
+	if r.body {
+		return copy(bs, xs[r.skip+CaduHeaderLen:r.skip+CaduTrailerIndex])
+	}
+	return copy(bs, xs[r.skip:])
+}
+
+// IdleChannel is the virtual channel reserved for idle (fill) frames.
+const IdleChannel = 0x3F
+
+// IsFillCadu reports whether bs is a fill frame. bs can either be a full cadu or
+// only its body. A cadu is a fill frame if it belongs to IdleChannel or if its
+// body is only made of the pattern byte (zero in most streams). Since the body
+// alone does not have the virtual channel, only its content is checked.
+func IsFillCadu(bs []byte, pattern byte) bool {
+	if len(bs) >= CaduLen && bytes.HasPrefix(bs, Magic) {
+		if bs[5]&0x3F == IdleChannel {
+			return true
+		}
+		bs = bs[CaduHeaderLen:CaduTrailerIndex]
+	}
+	if len(bs) == 0 {
+		return false
+	}
+	for _, b := range bs {
+		if b != pattern {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeCadu creates a cadu of the virtual channel vc with the given counter
+// (synchronization marker, header, body and CRC). The body is truncated or
+// padded with zeros to fill the cadu. The spacecraft identifier (0x45) and the
+// insert zone (fdc33fff) of the header are fixed.
+func EncodeCadu(counter uint32, vc uint8, body []byte) []byte {
+	bs := make([]byte, CaduLen)
+	copy(bs, Magic)
+	bs[4], bs[5] = 0x45, 0xC0|vc&0x3F
+	binary.BigEndian.PutUint32(bs[6:], (counter&CaduCounterMask)<<8)
+	binary.BigEndian.PutUint32(bs[10:], 0xfdc33fff)
+	copy(bs[CaduHeaderLen:CaduTrailerIndex], body)
+	binary.BigEndian.PutUint16(bs[CaduTrailerIndex:], Sum(bs[MagicLen:CaduTrailerIndex]))
+	return bs
+}
+
+// RateLimitReader limits the bytes read from r to rate bytes per second (with
+// bursts of at most rate bytes). If rate is not positive, r is returned as is.
+// It can wrap the reader given to CaduReader or VCDUReader to simulate a slow
+// feed.
+func RateLimitReader(r io.Reader, rate int) io.Reader {
+	if rate <= 0 {
+		return r
+	}
+	return ratelimit.Reader(r, ratelimit.NewBucketWithRate(float64(rate), int64(rate)))
+}
+
+type alignedReader struct {
+	inner  io.Reader
+	buffer []byte
+	offset int
+}
+
+// FrameAlignedReader returns, for each call to Read, the bytes of one full frame
+// (skip+CaduLen bytes) even if the frame is split between two successive reads
+// of r (eg when r is a reader concatenating multiple files).
+//
+// The skip bytes (eg the HRDFE header of each cadu) are part of the frame: they
+// are not removed but given back to the caller with the cadu that follows them,
+// so the same value of skip should be given to the VCDUReader/CaduReader
+// wrapping it. r should start at the beginning of a frame.
+//
+// Bytes left at the end of r that are not enough to build a full frame are
+// reported with a TruncatedCaduError instead of io.ErrUnexpectedEOF.
+func FrameAlignedReader(r io.Reader, skip int) io.Reader {
+	return &alignedReader{
+		inner:  r,
+		buffer: make([]byte, 0, skip+CaduLen),
+	}
+}
+
+func (r *alignedReader) Read(bs []byte) (int, error) {
+	if r.offset == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(bs, r.buffer[r.offset:])
+	if r.offset += n; r.offset >= len(r.buffer) {
+		r.buffer, r.offset = r.buffer[:0], 0
+	}
+	return n, nil
+}
+
+func (r *alignedReader) fill() error {
+	for len(r.buffer) < cap(r.buffer) {
+		n, err := r.inner.Read(r.buffer[len(r.buffer):cap(r.buffer)])
+		r.buffer = r.buffer[:len(r.buffer)+n]
+		if err == nil || len(r.buffer) == cap(r.buffer) {
+			continue
+		}
+		if err == io.EOF && len(r.buffer) > 0 {
+			err = TruncatedCaduError{Size: len(r.buffer)}
+		}
+		r.buffer = r.buffer[:0]
+		return err
 	}
-	return n, err
+	return nil
 }
@@ -0,0 +1,179 @@
+package erdle_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/busoc/erdle"
+	"github.com/busoc/erdle/erdletest"
+)
+
+func buildStream(counters ...uint32) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, c := range counters {
+		buf.Write(erdletest.BuildCadu(c, 1, nil))
+	}
+	return &buf
+}
+
+func TestVCDUReaderMissing(t *testing.T) {
+	r := erdle.VCDUReader(buildStream(1, 2, 6, 7), 0)
+	frame := make([]byte, erdle.CaduLen)
+
+	var gaps []erdle.MissingCaduError
+	for i := 0; ; i++ {
+		_, err := r.Read(frame)
+		if err == io.EOF {
+			if i != 4 {
+				t.Fatalf("expected 4 cadus, got %d", i)
+			}
+			break
+		}
+		switch e := err.(type) {
+		case nil:
+		case erdle.MissingCaduError:
+			gaps = append(gaps, e)
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(gaps) != 1 {
+		t.Fatalf("expected 1 gap, got %d", len(gaps))
+	}
+	if g := gaps[0]; g.From != 2 || g.To != 6 {
+		t.Errorf("unexpected gap: want 2 - 6, got %d - %d", g.From, g.To)
+	}
+}
+
+func TestVCDUReaderResync(t *testing.T) {
+	buf := buildStream(1)
+	buf.WriteByte(0x1a)
+	buf.Write(erdletest.BuildCadu(2, 1, nil))
+	buf.Write(erdletest.BuildCadu(3, 1, nil))
+
+	r := erdle.VCDUReader(buf, 0, erdle.WithResync())
+	frame := make([]byte, erdle.CaduLen)
+	want := []error{nil, erdle.ResyncError{Skipped: 1}, nil, io.EOF}
+	for i, w := range want {
+		if _, err := r.Read(frame); err != w {
+			t.Fatalf("cadu %d: want %v, got %v", i+1, w, err)
+		}
+	}
+}
+
+func TestVCDUReaderNoResync(t *testing.T) {
+	buf := buildStream(1)
+	buf.WriteByte(0x1a)
+	buf.Write(erdletest.BuildCadu(2, 1, nil))
+
+	r := erdle.VCDUReader(buf, 0)
+	frame := make([]byte, erdle.CaduLen)
+	if _, err := r.Read(frame); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := r.Read(frame); err != erdle.ErrMagic {
+		t.Fatalf("want %v, got %v", erdle.ErrMagic, err)
+	}
+}
+
+func TestVCDUReaderReorderFirstFrame(t *testing.T) {
+	// the first counter is within the reorder window of 0
+	buf := buildStream(erdle.CaduCounterMax-8, erdle.CaduCounterMax-7, erdle.CaduCounterMax-6)
+
+	r := erdle.VCDUReader(buf, 0, erdle.WithReorderWindow(16))
+	frame := make([]byte, erdle.CaduLen)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(frame); err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", i+1, err)
+		}
+	}
+}
+
+func TestVCDUReaderReorder(t *testing.T) {
+	buf := buildStream(10, 12, 11, 13)
+
+	r := erdle.VCDUReader(buf, 0, erdle.WithReorderWindow(4))
+	frame := make([]byte, erdle.CaduLen)
+	for i := 0; i < 4; i++ {
+		_, err := r.Read(frame)
+		if i == 2 && !erdle.IsOutOfOrder(err) {
+			t.Fatalf("cadu %d: expected OutOfOrderError, got %v", i+1, err)
+		}
+		if _, ok := erdle.IsMissingCadu(err); i == 1 && !ok {
+			t.Fatalf("cadu %d: expected MissingCaduError, got %v", i+1, err)
+		}
+		if (i == 0 || i == 3) && err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", i+1, err)
+		}
+	}
+}
+
+func TestRateLimitReader(t *testing.T) {
+	const count = 32
+
+	var counters []uint32
+	for i := 1; i <= count; i++ {
+		counters = append(counters, uint32(i))
+	}
+	rate := count / 2 * erdle.CaduLen
+
+	now := time.Now()
+	r := erdle.CaduReader(erdle.RateLimitReader(buildStream(counters...), rate), 0)
+	body := make([]byte, erdle.CaduBodyLen)
+	for i := 0; i < count; i++ {
+		if _, err := r.Read(body); err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", i+1, err)
+		}
+	}
+	// the first half is read in a burst, the second half in one second
+	if elapsed := time.Since(now); elapsed < 800*time.Millisecond {
+		t.Fatalf("cadus read too fast: %s", elapsed)
+	}
+}
+
+// splitReader gives the bytes of the underlying reader in chunks of at most n
+// bytes, like a reader concatenating files split in the middle of the frames.
+type splitReader struct {
+	bs []byte
+	n  int
+}
+
+func (s *splitReader) Read(bs []byte) (int, error) {
+	if len(s.bs) == 0 {
+		return 0, io.EOF
+	}
+	if len(bs) > s.n {
+		bs = bs[:s.n]
+	}
+	n := copy(bs, s.bs)
+	s.bs = s.bs[n:]
+	return n, nil
+}
+
+func TestFrameAlignedReader(t *testing.T) {
+	const skip = 8
+
+	var stream []byte
+	for i := uint32(1); i <= 3; i++ {
+		stream = append(stream, make([]byte, skip)...)
+		stream = append(stream, erdletest.BuildCadu(i, 1, nil)...)
+	}
+	stream = append(stream, make([]byte, skip+100)...)
+
+	r := erdle.VCDUReader(erdle.FrameAlignedReader(&splitReader{bs: stream, n: 700}, skip), skip)
+	frame := make([]byte, erdle.CaduLen)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(frame); err != nil {
+			t.Fatalf("cadu %d: unexpected error: %v", i+1, err)
+		}
+	}
+	_, err := r.Read(frame)
+	if e, ok := err.(erdle.TruncatedCaduError); !ok || e.Size != skip+100 {
+		t.Fatalf("expected TruncatedCaduError (%d bytes), got %v", skip+100, err)
+	}
+	if _, err := r.Read(frame); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}